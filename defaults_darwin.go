@@ -0,0 +1,8 @@
+// +build darwin
+
+package main
+
+const (
+	defaultOutboundIface = "en0"
+	defaultNIC           = "Wi-Fi"
+)
@@ -0,0 +1,10 @@
+// +build !darwin
+
+package main
+
+// The sockets are kept out of the tun by their mark on Linux, and the DNS is
+// set on the link of the default route.
+const (
+	defaultOutboundIface = ""
+	defaultNIC           = ""
+)
@@ -22,7 +22,7 @@ func Bind(ifce string) {
 			if err == nil {
 				ip := net.ParseIP(host)
 				if ip != nil && !ip.IsGlobalUnicast() {
-					logrus.Warnf("%s is not a global unicat address", ip)
+					logrus.Warnf("%s is not a global unicast address", ip)
 					return nil
 				}
 			}
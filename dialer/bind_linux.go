@@ -0,0 +1,55 @@
+// +build linux
+
+package dialer
+
+import (
+	"net"
+	"syscall"
+
+	"github.com/sirupsen/logrus"
+)
+
+// FwMark marks the sockets created by the dialer, so that the policy routing
+// rules installed by the system package can keep them out of the tun.
+const FwMark = 0x5357
+
+func Bind(ifce string) {
+	hook = func(dialer *net.Dialer) error {
+		// The mark alone keeps the sockets out of the tun.
+		iface := ifce
+		if iface != "" {
+			if _, err := net.InterfaceByName(iface); err != nil {
+				logrus.Warnf("outbound interface %s: %v, the sockets are only marked", iface, err)
+				iface = ""
+			}
+		}
+
+		dialer.Control = func(network, address string, c syscall.RawConn) error {
+			bindToDevice := iface != ""
+			host, _, err := net.SplitHostPort(address)
+			if err == nil {
+				ip := net.ParseIP(host)
+				if ip != nil && !ip.IsGlobalUnicast() {
+					logrus.Warnf("%s is not a global unicast address", ip)
+					bindToDevice = false
+				}
+			}
+
+			var sockErr error
+			err = c.Control(func(fd uintptr) {
+				if sockErr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_MARK, FwMark); sockErr != nil {
+					return
+				}
+				if bindToDevice {
+					sockErr = syscall.BindToDevice(int(fd), iface)
+				}
+			})
+			if err != nil {
+				return err
+			}
+			return sockErr
+		}
+
+		return nil
+	}
+}
@@ -1,8 +1,8 @@
 package dialer
 
 import (
-	"fmt"
 	"net"
+	"strconv"
 )
 
 type Conn struct {
@@ -30,5 +30,5 @@ func (t Addr) Network() string {
 }
 
 func (t Addr) String() string {
-	return fmt.Sprintf("%s:%d", t.IP.String(), t.Port)
+	return net.JoinHostPort(t.IP.String(), strconv.Itoa(t.Port))
 }
@@ -1,101 +1,299 @@
 package dns
 
 import (
+	"errors"
 	"net"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/golang/groupcache/lru"
+	"github.com/miekg/dns"
 	"github.com/sirupsen/logrus"
 )
 
 const (
 	timeout = time.Minute
+
+	// The answers expired for less than staleMax are served with staleTTL
+	// when the upstreams fail or don't answer within staleTimeout, as of
+	// RFC 8767.
+	staleMax     = 24 * time.Hour
+	staleTTL     = 30
+	staleTimeout = 1800 * time.Millisecond
+
+	// The upstreams which failed aren't asked again for the same question
+	// until failureTTL later.
+	failureTTL = 30 * time.Second
+
+	maxNegativeTTL = time.Hour
+
+	// An answer asked for prefetchHits times is refreshed ahead when a tenth
+	// of its TTL is left.
+	prefetchHits = 2
 )
 
+var (
+	errNoUpstream     = errors.New("no upstream")
+	errUpstreamFailed = errors.New("upstreams failed")
+)
+
+// HandlerOverCache caches the answers of the upstreams by question.
 type HandlerOverCache struct {
-	mutext    sync.RWMutex
-	upstreams []Handler
+	mutext    sync.Mutex
+	upstreams []*upstream
+	strategy  Strategy
 	cache     *lru.Cache
 }
 
-func NewHandlerOverCache(upstreams []Handler) *HandlerOverCache {
+type cacheKey struct {
+	name  string
+	qtype uint16
+}
+
+type cacheEntry struct {
+	msg        *dns.Msg
+	storedAt   time.Time
+	ttl        time.Duration
+	expiredAt  time.Time
+	retryAt    time.Time
+	hits       int
+	refreshing bool
+	waiters    []chan *dns.Msg
+}
+
+func NewHandlerOverCache(upstreams []Handler, strategy Strategy) *HandlerOverCache {
 	d := &HandlerOverCache{
-		cache:     lru.New(2 << 15),
-		upstreams: upstreams,
+		cache:    lru.New(2 << 15),
+		strategy: strategy,
+	}
+	for _, handler := range upstreams {
+		d.upstreams = append(d.upstreams, newUpstream(handler))
 	}
 	return d
 }
 
-func (d *HandlerOverCache) Lookup(host string) (ip net.IP, expiredAt time.Time) {
+func (d *HandlerOverCache) Lookup(host string) ([]net.IP, time.Time) {
+	ips, ttl := lookup(d.Exchange, host)
+	return ips, time.Now().Add(time.Duration(ttl) * time.Second)
+}
+
+// Exchange answers from the cache, or from the upstreams when it isn't
+// cached or has expired.
+func (d *HandlerOverCache) Exchange(m *dns.Msg) (*dns.Msg, error) {
+	if len(m.Question) != 1 || m.Question[0].Qclass != dns.ClassINET {
+		return d.exchange(m)
+	}
+
+	question := m.Question[0]
+	key := cacheKey{name: strings.ToLower(question.Name), qtype: question.Qtype}
+
 	d.mutext.Lock()
 
-	cached, ok := d.cache.Get(host)
-	var resolver *dnsResolver
-	if !ok {
-		resolver = &dnsResolver{}
-		d.cache.Add(host, resolver)
+	var entry *cacheEntry
+	if cached, ok := d.cache.Get(key); ok {
+		entry = cached.(*cacheEntry)
 	} else {
-		resolver = cached.(*dnsResolver)
-		if resolver.finished && resolver.answer.expiredAt.Before(time.Now()) {
-			resolver.finished = false
-			ok = false
-		}
+		entry = &cacheEntry{}
+		d.cache.Add(key, entry)
 	}
 
-	if resolver.finished {
+	now := time.Now()
+	if entry.msg != nil && now.Before(entry.expiredAt) {
+		entry.hits++
+		if entry.hits >= prefetchHits && entry.expiredAt.Sub(now) < entry.ttl/10 {
+			d.refresh(entry, m)
+		}
+		r := entry.reply(m, now)
 		d.mutext.Unlock()
-		return resolver.answer.ip, resolver.answer.expiredAt
+		return r, nil
 	}
 
-	ch := make(chan answerCache, 1)
-	resolver.waiters = append(resolver.waiters, ch)
-	d.mutext.Unlock()
+	if now.Before(entry.retryAt) {
+		r, err := entry.stale(m, now)
+		d.mutext.Unlock()
+		return r, err
+	}
 
-	if !ok {
-		go d.do(host)
+	wait := timeout
+	if entry.msg != nil && now.Before(entry.expiredAt.Add(staleMax)) {
+		wait = staleTimeout
 	}
 
-	timer := time.NewTimer(timeout)
+	ch := make(chan *dns.Msg, 1)
+	entry.waiters = append(entry.waiters, ch)
+	d.refresh(entry, m)
+	d.mutext.Unlock()
+
+	timer := time.NewTimer(wait)
 	defer timer.Stop()
 
+	// The answer of the upstreams is given as it is, even if it isn't
+	// cached.
 	select {
-	case answer := <-ch:
-		return answer.ip, answer.expiredAt
+	case r := <-ch:
+		if r != nil {
+			answer := r.Copy()
+			answer.Id = m.Id
+			answer.Question = m.Question
+			return answer, nil
+		}
 	case <-timer.C:
-		return nil, time.Now()
 	}
+
+	d.mutext.Lock()
+	defer d.mutext.Unlock()
+
+	now = time.Now()
+	if entry.msg != nil && now.Before(entry.expiredAt) {
+		return entry.reply(m, now), nil
+	}
+	return entry.stale(m, now)
+}
+
+// Stats tells how each of the upstreams has done.
+func (d *HandlerOverCache) Stats() []UpstreamStats {
+	stats := make([]UpstreamStats, 0, len(d.upstreams))
+	for _, upstream := range d.upstreams {
+		stats = append(stats, upstream.snapshot())
+	}
+	return stats
 }
 
 func (d *HandlerOverCache) String() string {
 	return "[CACHE]"
 }
 
-func (d *HandlerOverCache) do(host string) {
-	var ip net.IP
-	var expiredAt = time.Now()
+// refresh asks the upstreams for the entry unless they are being asked.
+func (d *HandlerOverCache) refresh(entry *cacheEntry, m *dns.Msg) {
+	if entry.refreshing {
+		return
+	}
+	entry.refreshing = true
+
+	query := new(dns.Msg)
+	query.SetQuestion(m.Question[0].Name, m.Question[0].Qtype)
+	query.RecursionDesired = true
 
-	for _, upstream := range d.upstreams {
-		ip, expiredAt = upstream.Lookup(host)
-		if ip != nil {
-			logrus.Infof("lookup %s -> %s via %s", host, ip, upstream.String())
-			break
+	go func() {
+		r, err := d.exchange(query)
+
+		d.mutext.Lock()
+		defer d.mutext.Unlock()
+
+		now := time.Now()
+		answered := err == nil && r.Rcode != dns.RcodeServerFailure
+		if answered {
+			if ttl := ttlOf(r); ttl > 0 {
+				entry.msg = r
+				entry.storedAt = now
+				entry.ttl = ttl
+				entry.expiredAt = now.Add(ttl)
+				entry.hits = 0
+			}
+			entry.retryAt = time.Time{}
+		} else {
+			entry.retryAt = now.Add(failureTTL)
+			r = nil
+		}
+
+		entry.refreshing = false
+		for _, ch := range entry.waiters {
+			ch <- r
 		}
-		logrus.Warnf("failed to lookup %s via %s", host, upstream.String())
+		entry.waiters = nil
+	}()
+}
+
+// exchange passes the message through to the upstreams until one of them
+// answers.
+func (d *HandlerOverCache) exchange(m *dns.Msg) (*dns.Msg, error) {
+	type exchanged struct {
+		r   *dns.Msg
+		err error
 	}
 
-	d.mutext.Lock()
-	defer d.mutext.Unlock()
+	v, upstream, ok := query(d.strategy, d.upstreams, func(upstream Handler) (interface{}, bool) {
+		r, err := upstream.Exchange(m)
+		if err != nil || r.Rcode == dns.RcodeServerFailure {
+			logrus.Warnf("failed to exchange %s via %s: %v", questionString(m), upstream.String(), err)
+			return exchanged{r: r, err: err}, false
+		}
+		return exchanged{r: r}, true
+	})
+	if ok {
+		logrus.Infof("exchange %s via %s", questionString(m), upstream.String())
+	}
+	if v == nil {
+		return nil, errNoUpstream
+	}
+	return v.(exchanged).r, v.(exchanged).err
+}
 
-	cache, _ := d.cache.Get(host)
-	resolver := cache.(*dnsResolver)
-	resolver.finished = true
-	resolver.answer.ip = ip
-	resolver.answer.expiredAt = expiredAt
+// reply answers m with the cached message, whose TTLs have gone down since
+// it was stored.
+func (e *cacheEntry) reply(m *dns.Msg, now time.Time) *dns.Msg {
+	elapsed := uint32(now.Sub(e.storedAt) / time.Second)
+	return e.copy(m, func(ttl uint32) uint32 {
+		if ttl < elapsed {
+			return 0
+		}
+		return ttl - elapsed
+	})
+}
+
+// stale answers m with the expired message, if it isn't too old.
+func (e *cacheEntry) stale(m *dns.Msg, now time.Time) (*dns.Msg, error) {
+	if e.msg == nil || !now.Before(e.expiredAt.Add(staleMax)) {
+		return nil, errUpstreamFailed
+	}
+	return e.copy(m, func(uint32) uint32 { return staleTTL }), nil
+}
 
-	for _, ch := range resolver.waiters {
-		ch <- resolver.answer
-		close(ch)
+func (e *cacheEntry) copy(m *dns.Msg, ttl func(uint32) uint32) *dns.Msg {
+	r := e.msg.Copy()
+	r.Id = m.Id
+	r.Question = m.Question
+	for _, section := range [][]dns.RR{r.Answer, r.Ns, r.Extra} {
+		for _, rr := range section {
+			if rr.Header().Rrtype != dns.TypeOPT {
+				rr.Header().Ttl = ttl(rr.Header().Ttl)
+			}
+		}
+	}
+	return r
+}
+
+// ttlOf is how long the answer can be cached, which is only NOERROR or
+// NXDOMAIN. The negative answers are cached as long as the SOA minimum tells,
+// as of RFC 2308.
+func ttlOf(r *dns.Msg) time.Duration {
+	negative := r.Rcode == dns.RcodeNameError || (r.Rcode == dns.RcodeSuccess && len(r.Answer) == 0)
+	if negative {
+		for _, rr := range r.Ns {
+			if soa, ok := rr.(*dns.SOA); ok {
+				ttl := soa.Minttl
+				if soa.Hdr.Ttl < ttl {
+					ttl = soa.Hdr.Ttl
+				}
+				if d := time.Duration(ttl) * time.Second; d < maxNegativeTTL {
+					return d
+				}
+				return maxNegativeTTL
+			}
+		}
+		return 0
+	}
+
+	if r.Rcode != dns.RcodeSuccess {
+		return 0
+	}
+
+	ttl := r.Answer[0].Header().Ttl
+	for _, rr := range r.Answer[1:] {
+		if rr.Header().Ttl < ttl {
+			ttl = rr.Header().Ttl
+		}
 	}
-	resolver.waiters = nil
+	return time.Duration(ttl) * time.Second
 }
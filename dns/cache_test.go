@@ -0,0 +1,157 @@
+package dns
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+type scriptedHandler struct {
+	mutex   sync.Mutex
+	queries int
+	answer  func(m *dns.Msg) (*dns.Msg, error)
+}
+
+func (h *scriptedHandler) Lookup(string) ([]net.IP, time.Time) {
+	return nil, time.Now()
+}
+
+func (h *scriptedHandler) Exchange(m *dns.Msg) (*dns.Msg, error) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.queries++
+	return h.answer(m)
+}
+
+func (h *scriptedHandler) String() string {
+	return "SCRIPTED"
+}
+
+func (h *scriptedHandler) count() int {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	return h.queries
+}
+
+func answerA(m *dns.Msg) (*dns.Msg, error) {
+	r := new(dns.Msg)
+	r.SetReply(m)
+	rr, err := dns.NewRR(m.Question[0].Name + " 300 IN A 1.2.3.4")
+	r.Answer = append(r.Answer, rr)
+	return r, err
+}
+
+func expire(d *HandlerOverCache, name string, qtype uint16, by time.Duration) {
+	d.mutext.Lock()
+	defer d.mutext.Unlock()
+	cached, _ := d.cache.Get(cacheKey{name: name, qtype: qtype})
+	entry := cached.(*cacheEntry)
+	entry.storedAt = entry.storedAt.Add(-by)
+	entry.expiredAt = entry.expiredAt.Add(-by)
+}
+
+func ask(t *testing.T, d *HandlerOverCache, name string) *dns.Msg {
+	m := new(dns.Msg)
+	m.SetQuestion(name, dns.TypeA)
+	r, err := d.Exchange(m)
+	require.NoError(t, err)
+	require.Equal(t, m.Id, r.Id)
+	return r
+}
+
+func TestCacheNegative(t *testing.T) {
+	upstream := &scriptedHandler{answer: func(m *dns.Msg) (*dns.Msg, error) {
+		r := new(dns.Msg)
+		r.SetRcode(m, dns.RcodeNameError)
+		soa, err := dns.NewRR("example.com. 3600 IN SOA ns.example.com. admin.example.com. 1 7200 900 1209600 60")
+		r.Ns = append(r.Ns, soa)
+		return r, err
+	}}
+	d := NewHandlerOverCache([]Handler{upstream}, StrategySequential)
+
+	require.Equal(t, dns.RcodeNameError, ask(t, d, "nx.example.com.").Rcode)
+	require.Equal(t, dns.RcodeNameError, ask(t, d, "nx.example.com.").Rcode)
+	require.Equal(t, 1, upstream.count())
+
+	expire(d, "nx.example.com.", dns.TypeA, 61*time.Second)
+	ask(t, d, "nx.example.com.")
+	require.Equal(t, 2, upstream.count())
+}
+
+func TestCacheServeStale(t *testing.T) {
+	var failed bool
+	upstream := &scriptedHandler{answer: func(m *dns.Msg) (*dns.Msg, error) {
+		if failed {
+			return nil, errors.New("unreachable")
+		}
+		return answerA(m)
+	}}
+	d := NewHandlerOverCache([]Handler{upstream}, StrategySequential)
+
+	r := ask(t, d, "example.com.")
+	require.Equal(t, uint32(300), r.Answer[0].Header().Ttl)
+
+	upstream.mutex.Lock()
+	failed = true
+	upstream.mutex.Unlock()
+	expire(d, "example.com.", dns.TypeA, time.Hour)
+
+	r = ask(t, d, "example.com.")
+	require.Equal(t, uint32(staleTTL), r.Answer[0].Header().Ttl)
+	ask(t, d, "example.com.")
+	require.Equal(t, 2, upstream.count())
+
+	expire(d, "example.com.", dns.TypeA, staleMax)
+	m := new(dns.Msg)
+	m.SetQuestion("example.com.", dns.TypeA)
+	_, err := d.Exchange(m)
+	require.Error(t, err)
+}
+
+func TestCachePrefetch(t *testing.T) {
+	upstream := &scriptedHandler{answer: answerA}
+	d := NewHandlerOverCache([]Handler{upstream}, StrategySequential)
+
+	ask(t, d, "example.com.")
+	ask(t, d, "example.com.")
+	expire(d, "example.com.", dns.TypeA, 280*time.Second)
+
+	r := ask(t, d, "example.com.")
+	require.Equal(t, uint32(20), r.Answer[0].Header().Ttl)
+	require.Eventually(t, func() bool {
+		return ask(t, d, "example.com.").Answer[0].Header().Ttl == 300
+	}, time.Second, 10*time.Millisecond)
+	require.Equal(t, 2, upstream.count())
+}
+
+func TestCacheUncacheable(t *testing.T) {
+	rcode := dns.RcodeRefused
+	upstream := &scriptedHandler{answer: func(m *dns.Msg) (*dns.Msg, error) {
+		r := new(dns.Msg)
+		r.SetRcode(m, rcode)
+		if rcode == dns.RcodeSuccess {
+			rr, err := dns.NewRR(m.Question[0].Name + " 0 IN A 1.2.3.4")
+			r.Answer = append(r.Answer, rr)
+			return r, err
+		}
+		return r, nil
+	}}
+	d := NewHandlerOverCache([]Handler{upstream}, StrategySequential)
+
+	require.Equal(t, dns.RcodeRefused, ask(t, d, "example.com.").Rcode)
+	require.Equal(t, dns.RcodeRefused, ask(t, d, "example.com.").Rcode)
+	require.Equal(t, 2, upstream.count())
+
+	upstream.mutex.Lock()
+	rcode = dns.RcodeSuccess
+	upstream.mutex.Unlock()
+	r := ask(t, d, "example.org.")
+	require.Equal(t, uint32(0), r.Answer[0].Header().Ttl)
+	ask(t, d, "example.org.")
+	require.Equal(t, 4, upstream.count())
+}
@@ -1,18 +1,48 @@
 package dns
 
 import (
+	"container/list"
+	"encoding/json"
 	"errors"
+	"fmt"
+	"io/ioutil"
 	"net"
+	"os"
+	"path/filepath"
 	"sync"
 )
 
+// fakeIPPool hands out the addresses of the range, the network and the
+// gateway ones excepted. When all of them are taken, the least recently used
+// address without open connections is reused.
 type fakeIPPool struct {
-	mutex         sync.Mutex
-	min           uint32
-	max           uint32
-	offset        uint32
-	answerCache   map[string]uint32
-	questionCache map[uint32]string
+	mutex      sync.Mutex
+	min        uint32
+	max        uint32
+	next       uint32
+	ipNet      *net.IPNet
+	lru        *list.List
+	hosts      map[string]*list.Element
+	ips        map[uint32]*list.Element
+	evictions  uint64
+	collisions uint64
+}
+
+type fakeIP struct {
+	num  uint32
+	host string
+	pins int
+}
+
+// FakeIPStats tells how well the fake IP range fits. Collisions are the
+// addresses reused while they still had open connections, which happens only
+// when all of them have.
+type FakeIPStats struct {
+	Size       int
+	Capacity   int
+	Pinned     int
+	Evictions  uint64
+	Collisions uint64
 }
 
 func newFakeIPPool(ipRange string) (*fakeIPPool, error) {
@@ -25,18 +55,121 @@ func newFakeIPPool(ipRange string) (*fakeIPPool, error) {
 	}
 
 	ones, bits := ipNet.Mask.Size()
+	if bits-ones < 2 {
+		return nil, errors.New("IP range is too small")
+	}
 	min := ipv4ToUint(ipNet.IP) + 2
-	max := min + (1<<(bits-ones) - 2)
+	max := ipv4ToUint(ipNet.IP) + 1<<(bits-ones) - 2
 
 	p := &fakeIPPool{
-		min:           min,
-		max:           max,
-		answerCache:   make(map[string]uint32),
-		questionCache: make(map[uint32]string),
+		min:   min,
+		max:   max,
+		next:  min,
+		ipNet: ipNet,
+		lru:   list.New(),
+		hosts: make(map[string]*list.Element),
+		ips:   make(map[uint32]*list.Element),
 	}
 	return p, nil
 }
 
+// fakeIPSnapshot is what the pool is persisted as, from the least recently
+// used address to the most.
+type fakeIPSnapshot struct {
+	Range   string         `json:"range"`
+	Entries []fakeIPRecord `json:"entries"`
+}
+
+type fakeIPRecord struct {
+	IP   string `json:"ip"`
+	Host string `json:"host"`
+}
+
+func (p *fakeIPPool) save(path string) error {
+	p.mutex.Lock()
+	snapshot := fakeIPSnapshot{
+		Range:   p.ipNet.String(),
+		Entries: make([]fakeIPRecord, 0, p.lru.Len()),
+	}
+	for e := p.lru.Back(); e != nil; e = e.Prev() {
+		ip := e.Value.(*fakeIP)
+		snapshot.Entries = append(snapshot.Entries, fakeIPRecord{
+			IP:   uintToIPv4(ip.num).String(),
+			Host: ip.host,
+		})
+	}
+	p.mutex.Unlock()
+
+	data, err := json.Marshal(snapshot)
+	if err != nil {
+		return err
+	}
+
+	// The file is written to a new one of a random name next to it, which
+	// can't be planted beforehand, and then replaces it.
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(dir, filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(data)
+	if e := tmp.Close(); err == nil {
+		err = e
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
+
+// load restores the pool saved for the same IP range.
+func (p *fakeIPPool) load(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	var snapshot fakeIPSnapshot
+	if err := json.Unmarshal(data, &snapshot); err != nil {
+		return err
+	}
+	if snapshot.Range != p.ipNet.String() {
+		return fmt.Errorf("fake IPs of %s don't belong to %s", snapshot.Range, p.ipNet)
+	}
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	for _, record := range snapshot.Entries {
+		ip := net.ParseIP(record.IP).To4()
+		if ip == nil {
+			continue
+		}
+		num := ipv4ToUint(ip)
+		if num < p.min || num > p.max || record.Host == "" {
+			continue
+		}
+		if e, ok := p.ips[num]; ok {
+			p.remove(e)
+		}
+		if e, ok := p.hosts[record.Host]; ok {
+			p.remove(e)
+		}
+		p.add(num, record.Host)
+	}
+	return nil
+}
+
+func (p *fakeIPPool) contains(ip net.IP) bool {
+	return p.ipNet.Contains(ip)
+}
+
 func (p *fakeIPPool) reverseLookup(ip net.IP) (string, bool) {
 	if ip = ip.To4(); ip == nil {
 		return "", false
@@ -45,33 +178,117 @@ func (p *fakeIPPool) reverseLookup(ip net.IP) (string, bool) {
 	p.mutex.Lock()
 	defer p.mutex.Unlock()
 
-	v, ok := p.questionCache[ipv4ToUint(ip)]
-	return v, ok
+	e, ok := p.ips[ipv4ToUint(ip)]
+	if !ok {
+		return "", false
+	}
+	p.lru.MoveToFront(e)
+	return e.Value.(*fakeIP).host, true
 }
 
 func (p *fakeIPPool) lookup(host string) net.IP {
 	p.mutex.Lock()
 	defer p.mutex.Unlock()
 
-	if ip, ok := p.answerCache[host]; ok {
-		return uintToIPv4(ip)
+	if e, ok := p.hosts[host]; ok {
+		p.lru.MoveToFront(e)
+		return uintToIPv4(e.Value.(*fakeIP).num)
 	}
 
-	p.offset = (p.offset + 1) % (p.max - p.min)
-	ipNum := p.min + p.offset - 1
+	num := p.allocate()
+	p.add(num, host)
 
-	p.overwrite(ipNum, host)
+	return uintToIPv4(num)
+}
+
+// pin keeps the address from being reused until the returned func is called.
+func (p *fakeIPPool) pin(ip net.IP) (release func()) {
+	if ip = ip.To4(); ip == nil {
+		return func() {}
+	}
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	e, ok := p.ips[ipv4ToUint(ip)]
+	if !ok {
+		return func() {}
+	}
+	p.lru.MoveToFront(e)
 
-	return uintToIPv4(ipNum)
+	pinned := e.Value.(*fakeIP)
+	pinned.pins++
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			p.mutex.Lock()
+			defer p.mutex.Unlock()
+
+			pinned.pins--
+			if p.ips[pinned.num] == e {
+				p.lru.MoveToFront(e)
+			}
+		})
+	}
+}
+
+func (p *fakeIPPool) stats() FakeIPStats {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	stats := FakeIPStats{
+		Size:       p.lru.Len(),
+		Capacity:   int(p.max - p.min + 1),
+		Evictions:  p.evictions,
+		Collisions: p.collisions,
+	}
+	for e := p.lru.Front(); e != nil; e = e.Next() {
+		if e.Value.(*fakeIP).pins > 0 {
+			stats.Pinned++
+		}
+	}
+	return stats
 }
 
-func (p *fakeIPPool) overwrite(ipNum uint32, host string) {
-	if answer := p.questionCache[ipNum]; answer != "" {
-		delete(p.answerCache, answer)
+func (p *fakeIPPool) allocate() uint32 {
+	for p.next <= p.max {
+		num := p.next
+		p.next++
+		if _, ok := p.ips[num]; !ok {
+			return num
+		}
+	}
+
+	// The pinned addresses in the way are still in use, so they are
+	// refreshed as well.
+	for i := p.lru.Len(); i > 0; i-- {
+		e := p.lru.Back()
+		ip := e.Value.(*fakeIP)
+		if ip.pins == 0 {
+			p.remove(e)
+			p.evictions++
+			return ip.num
+		}
+		p.lru.MoveToFront(e)
 	}
 
-	p.answerCache[host] = ipNum
-	p.questionCache[ipNum] = host
+	e := p.lru.Back()
+	p.remove(e)
+	p.collisions++
+	return e.Value.(*fakeIP).num
+}
+
+func (p *fakeIPPool) add(num uint32, host string) {
+	e := p.lru.PushFront(&fakeIP{num: num, host: host})
+	p.hosts[host] = e
+	p.ips[num] = e
+}
+
+func (p *fakeIPPool) remove(e *list.Element) {
+	ip := p.lru.Remove(e).(*fakeIP)
+	delete(p.hosts, ip.host)
+	delete(p.ips, ip.num)
 }
 
 func ipv4ToUint(ip net.IP) uint32 {
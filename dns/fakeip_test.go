@@ -0,0 +1,111 @@
+package dns
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFakeIPPoolPersistence(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fakeip")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "fakeip.json")
+
+	p, err := newFakeIPPool("198.18.0.0/16")
+	require.NoError(t, err)
+	ip := p.lookup("example.com")
+	require.NoError(t, p.save(path))
+
+	restored, err := newFakeIPPool("198.18.0.0/16")
+	require.NoError(t, err)
+	require.NoError(t, restored.load(path))
+	host, ok := restored.reverseLookup(ip)
+	require.True(t, ok)
+	require.Equal(t, "example.com", host)
+	require.Equal(t, ip, restored.lookup("example.com"))
+	require.NotEqual(t, ip, restored.lookup("example.org"))
+
+	other, err := newFakeIPPool("198.19.0.0/16")
+	require.NoError(t, err)
+	require.Error(t, other.load(path))
+}
+
+func TestFakeIPPoolSavePlanted(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fakeip")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "sandwich", "fakeip.json")
+
+	victim := filepath.Join(dir, "victim")
+	require.NoError(t, ioutil.WriteFile(victim, []byte("victim"), 0600))
+	require.NoError(t, os.Mkdir(filepath.Dir(path), 0700))
+	require.NoError(t, os.Symlink(victim, path+".tmp"))
+
+	p, err := newFakeIPPool("198.18.0.0/16")
+	require.NoError(t, err)
+	p.lookup("example.com")
+	require.NoError(t, p.save(path))
+
+	data, err := ioutil.ReadFile(victim)
+	require.NoError(t, err)
+	require.Equal(t, "victim", string(data))
+	files, err := ioutil.ReadDir(filepath.Dir(path))
+	require.NoError(t, err)
+	require.Len(t, files, 2)
+}
+
+func TestFakeIPPoolLRU(t *testing.T) {
+	p, err := newFakeIPPool("198.18.0.0/29")
+	require.NoError(t, err)
+	require.Equal(t, 5, p.stats().Capacity)
+
+	hosts := []string{"a.com", "b.com", "c.com", "d.com", "e.com"}
+	ips := make(map[string]string)
+	for _, host := range hosts {
+		ip := p.lookup(host)
+		require.True(t, p.contains(ip))
+		require.NotEqual(t, "198.18.0.1", ip.String())
+		ips[host] = ip.String()
+	}
+	require.Len(t, ips, 5)
+
+	p.lookup("a.com")
+	release := p.pin(p.lookup("b.com"))
+	p.reverseLookup(p.lookup("c.com"))
+
+	require.Equal(t, ips["d.com"], p.lookup("f.com").String())
+	require.Equal(t, ips["e.com"], p.lookup("g.com").String())
+	require.Equal(t, ips["a.com"], p.lookup("h.com").String())
+	require.Equal(t, ips["c.com"], p.lookup("i.com").String())
+	require.Equal(t, ips["d.com"], p.lookup("j.com").String())
+
+	host, ok := p.reverseLookup(net.ParseIP(ips["b.com"]))
+	require.True(t, ok)
+	require.Equal(t, "b.com", host)
+
+	stats := p.stats()
+	require.Equal(t, 1, stats.Pinned)
+	require.Equal(t, uint64(5), stats.Evictions)
+	require.Equal(t, uint64(0), stats.Collisions)
+
+	release()
+	require.Equal(t, 0, p.stats().Pinned)
+}
+
+func TestFakeIPPoolCollision(t *testing.T) {
+	p, err := newFakeIPPool("198.18.0.0/30")
+	require.NoError(t, err)
+
+	release := p.pin(p.lookup("a.com"))
+	defer release()
+	p.lookup("b.com")
+
+	_, ok := p.reverseLookup(p.lookup("b.com"))
+	require.True(t, ok)
+	require.Equal(t, uint64(1), p.stats().Collisions)
+}
@@ -1,132 +1,352 @@
 package dns
 
 import (
+	"encoding/binary"
+	"io"
 	"net"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/Dreamacro/clash/common/pool"
 	"github.com/miekg/dns"
 	"github.com/sirupsen/logrus"
 )
 
+const (
+	dnsIdleTimeout = 10 * time.Second
+)
+
 type Hijacker struct {
-	pool  *fakeIPPool
-	mutex sync.Mutex
-	hosts HandlerOverHost
+	pool     *fakeIPPool
+	realIPs  *realIPTable
+	mode     Mode
+	mutex    sync.Mutex
+	hosts    HandlerOverHost
+	upstream Handler
 }
 
-func NewHijacker(ipRange string) (*Hijacker, error) {
+// NewHijacker answers A questions with the fake IPs of ipRange, or with the
+// real ones of upstream in ModeRealIP, and passes the questions it can't
+// answer through to upstream.
+func NewHijacker(ipRange string, mode Mode, upstream Handler) (*Hijacker, error) {
 	p, err := newFakeIPPool(ipRange)
 	if err != nil {
 		return nil, err
 	}
 
 	return &Hijacker{
-		pool:  p,
-		hosts: NewHandlerOverHost(0),
+		pool:     p,
+		realIPs:  newRealIPTable(realIPCapacity),
+		mode:     mode,
+		hosts:    NewHandlerOverHost(0),
+		upstream: upstream,
 	}, nil
 }
 
+// TryHijack serves the DNS queries over the UDP or TCP connection to port 53
+// until it is idle. The connection is given back if it doesn't start with a
+// DNS query.
 func (h *Hijacker) TryHijack(conn net.Conn) (net.Conn, bool) {
 	if _, port, _ := net.SplitHostPort(conn.RemoteAddr().String()); port != "53" {
 		return conn, false
 	}
 
-	buf := pool.Get(512) // DNS query max size is 512
+	buf := pool.Get(dns.MaxMsgSize)
 	defer pool.Put(buf)
 
-	n, err := conn.Read(buf)
-	if err != nil {
-		logrus.Errorf("got error while hijacking connection %v: %v", conn.RemoteAddr(), err)
-		return nil, true
+	w := dnsResponseWriter{Conn: conn, tcp: conn.RemoteAddr().Network() == "tcp"}
+	for first := true; ; first = false {
+		conn.SetReadDeadline(time.Now().Add(dnsIdleTimeout))
+
+		msg, err := w.readMsg(buf)
+		if err != nil {
+			if first {
+				logrus.Errorf("got error while hijacking connection %v: %v", conn.RemoteAddr(), err)
+			}
+			conn.Close()
+			return nil, true
+		}
+
+		query := new(dns.Msg)
+		if err := query.Unpack(msg); err != nil {
+			if !first {
+				continue
+			}
+			conn.SetReadDeadline(time.Time{})
+			return &readConn{
+				Conn: conn,
+				read: w.frame(msg),
+			}, false
+		}
+
+		w.size = udpSize(query)
+		h.ServeDNS(w, query)
+	}
+}
+
+func (h *Hijacker) ServeDNS(w dns.ResponseWriter, r *dns.Msg) {
+	if len(r.Question) == 0 {
+		handleFailed(w, r, dns.RcodeFormatError)
+		return
 	}
 
-	question := new(dns.Msg)
+	switch r.Question[0].Qtype {
+	case dns.TypeA, dns.TypeAAAA:
+		h.serveAddress(w, r)
+	case dns.TypePTR:
+		h.servePTR(w, r)
+	default:
+		forward(h.upstream, w, r)
+	}
+}
+
+func (h *Hijacker) serveAddress(w dns.ResponseWriter, r *dns.Msg) {
+	question := r.Question[0]
+	host := strings.TrimRight(question.Name, ".")
 
-	if err := question.Unpack(buf[:n]); err != nil {
-		read := make([]byte, n)
-		copy(read, buf[:n])
-		return &readConn{
-			Conn: conn,
-			read: read,
-		}, false
+	if answer, err := h.hosts.Exchange(r); err == nil {
+		logrus.Infof("dns hijack %s in hosts", questionString(r))
+		w.WriteMsg(answer)
+		return
 	}
 
-	h.ServeDNS(dnsResponseWriter{Conn: conn}, question)
+	if !strings.Contains(host, ".") {
+		logrus.Debugf("dns hijacking detection: %s", host)
+		handleFailed(w, r, dns.RcodeNameError)
+		return
+	}
+
+	if h.mode == ModeRealIP {
+		h.serveRealIP(w, r, host)
+		return
+	}
+
+	answer := newAnswer(r)
+
+	// There are no fake IPv6 addresses, the empty answer makes the
+	// clients fall back to IPv4.
+	if question.Qtype == dns.TypeAAAA {
+		w.WriteMsg(answer)
+		return
+	}
+
+	ip := h.pool.lookup(host)
+	answer.Answer = append(answer.Answer, &dns.A{
+		Hdr: dns.RR_Header{Name: question.Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 0},
+		A:   ip,
+	})
+
+	logrus.Infof("dns hijack %s -> %s in fakeip", host, ip)
 
-	return nil, true
+	w.WriteMsg(answer)
 }
 
-func (h *Hijacker) ServeDNS(w dns.ResponseWriter, r *dns.Msg) {
-	answer := r.Copy()
-	answer.SetRcode(r, dns.RcodeSuccess)
-	answer.Authoritative = true
-	answer.RecursionAvailable = true
+// serveRealIP answers with the addresses of the upstream, and remembers
+// their domain.
+func (h *Hijacker) serveRealIP(w dns.ResponseWriter, r *dns.Msg, host string) {
+	answer := exchange(h.upstream, w, r)
+	if answer == nil {
+		return
+	}
 
-	for _, question := range r.Question {
-		domain := question.Name
-		host := strings.TrimRight(domain, ".")
-
-		ip, _ := h.hosts.Lookup(host)
-		if ip != nil {
-			answer.Answer = append(answer.Answer, &dns.A{
-				Hdr: dns.RR_Header{Name: domain, Rrtype: ipToType(ip), Class: dns.ClassINET, Ttl: 0},
-				A:   ip,
-			})
-			logrus.Infof("dns hijack %s -> %s in hosts", host, ip)
-			continue
+	var ips []net.IP
+	for _, rr := range answer.Answer {
+		switch rr := rr.(type) {
+		case *dns.A:
+			ips = append(ips, rr.A)
+		case *dns.AAAA:
+			ips = append(ips, rr.AAAA)
 		}
+	}
+	h.realIPs.add(host, ips)
 
-		if !strings.Contains(host, ".") {
-			logrus.Debugf("dns hijacking detection: %s", host)
-			handleFailed(w, r, dns.RcodeNameError)
-			return
-		}
+	logrus.Infof("dns hijack %s -> %v in realip", host, ips)
+
+	w.WriteMsg(answer)
+}
+
+// servePTR answers the reverse lookups of the fake IPs with their domains.
+func (h *Hijacker) servePTR(w dns.ResponseWriter, r *dns.Msg) {
+	question := r.Question[0]
 
-		ip = h.pool.lookup(host)
-		answer.Answer = append(answer.Answer, &dns.A{
-			Hdr: dns.RR_Header{Name: domain, Rrtype: ipToType(ip), Class: dns.ClassINET, Ttl: 0},
-			A:   ip,
-		})
+	ip := ptrToIP(question.Name)
+	if ip == nil || !h.pool.contains(ip) {
+		forward(h.upstream, w, r)
+		return
+	}
 
-		logrus.Infof("dns hijack %s -> %s in fakeip", host, ip)
+	host, ok := h.pool.reverseLookup(ip)
+	if !ok {
+		handleFailed(w, r, dns.RcodeNameError)
+		return
 	}
 
+	answer := newAnswer(r)
+	answer.Answer = append(answer.Answer, &dns.PTR{
+		Hdr: dns.RR_Header{Name: question.Name, Rrtype: dns.TypePTR, Class: dns.ClassINET, Ttl: 0},
+		Ptr: dns.Fqdn(host),
+	})
+
+	logrus.Infof("dns hijack %s -> %s in fakeip", ip, host)
+
 	w.WriteMsg(answer)
 }
 
+func forward(upstream Handler, w dns.ResponseWriter, r *dns.Msg) {
+	if answer := exchange(upstream, w, r); answer != nil {
+		logrus.Infof("dns forward %s", questionString(r))
+		w.WriteMsg(answer)
+	}
+}
+
+// exchange asks the upstream, or answers the failure and returns nil.
+func exchange(upstream Handler, w dns.ResponseWriter, r *dns.Msg) *dns.Msg {
+	if upstream == nil {
+		handleFailed(w, r, dns.RcodeNotImplemented)
+		return nil
+	}
+
+	answer, err := upstream.Exchange(r)
+	if err != nil {
+		logrus.Warnf("failed to forward dns %s: %v", questionString(r), err)
+		handleFailed(w, r, dns.RcodeServerFailure)
+		return nil
+	}
+
+	answer.Id = r.Id
+	return answer
+}
+
 func (h *Hijacker) ReverseLookup(ip net.IP) (string, bool) {
 	return h.pool.reverseLookup(ip)
 }
 
+// Domain returns the domain the real IP was last answered for in
+// ModeRealIP.
+func (h *Hijacker) Domain(ip net.IP) (string, bool) {
+	return h.realIPs.lookup(ip)
+}
+
+// Pin keeps the fake IP, if it is one, from being given to another domain
+// until the returned func is called.
+func (h *Hijacker) Pin(ip net.IP) (release func()) {
+	return h.pool.pin(ip)
+}
+
+func (h *Hijacker) Stats() FakeIPStats {
+	return h.pool.stats()
+}
+
+// Save persists the fake IPs to the file, so that the answers cached by the
+// OS and browsers stay valid after restarts.
+func (h *Hijacker) Save(path string) error {
+	return h.pool.save(path)
+}
+
+// Load restores the fake IPs saved to the file for the same IP range.
+func (h *Hijacker) Load(path string) error {
+	return h.pool.load(path)
+}
+
+func newAnswer(r *dns.Msg) *dns.Msg {
+	answer := r.Copy()
+	answer.SetRcode(r, dns.RcodeSuccess)
+	answer.Authoritative = true
+	answer.RecursionAvailable = true
+	return answer
+}
+
+// ptrToIP parses the IPv4 address of a name in in-addr.arpa.
+func ptrToIP(name string) net.IP {
+	name = strings.ToLower(dns.Fqdn(name))
+	if !strings.HasSuffix(name, ".in-addr.arpa.") {
+		return nil
+	}
+
+	labels := strings.Split(strings.TrimSuffix(name, ".in-addr.arpa."), ".")
+	if len(labels) != net.IPv4len {
+		return nil
+	}
+	for i, j := 0, len(labels)-1; i < j; i, j = i+1, j-1 {
+		labels[i], labels[j] = labels[j], labels[i]
+	}
+	return net.ParseIP(strings.Join(labels, ".")).To4()
+}
+
+func questionString(m *dns.Msg) string {
+	if len(m.Question) == 0 {
+		return ""
+	}
+	question := m.Question[0]
+	return dns.TypeToString[question.Qtype] + " " + strings.TrimRight(question.Name, ".")
+}
+
 func handleFailed(w dns.ResponseWriter, r *dns.Msg, code int) {
 	m := new(dns.Msg)
 	m.SetRcode(r, code)
 	w.WriteMsg(m)
 }
 
-func ipToType(ip net.IP) uint16 {
-	if len(ip) == net.IPv4len {
-		return dns.TypeA
-	}
-	if len(ip) == net.IPv6len {
-		return dns.TypeAAAA
+// udpSize is the max size of the UDP response to the query, which is
+// advertised by EDNS0.
+func udpSize(query *dns.Msg) int {
+	if opt := query.IsEdns0(); opt != nil && opt.UDPSize() > dns.MinMsgSize {
+		return int(opt.UDPSize())
 	}
-	return dns.TypeNone
+	return dns.MinMsgSize
 }
 
 type dnsResponseWriter struct {
 	net.Conn
+	tcp  bool
+	size int
+}
+
+// readMsg reads the next message, which is prefixed with its length over
+// TCP.
+func (d dnsResponseWriter) readMsg(buf []byte) ([]byte, error) {
+	if !d.tcp {
+		n, err := d.Conn.Read(buf)
+		return buf[:n], err
+	}
+
+	var length [2]byte
+	if _, err := io.ReadFull(d.Conn, length[:]); err != nil {
+		return nil, err
+	}
+	n := int(binary.BigEndian.Uint16(length[:]))
+	if _, err := io.ReadFull(d.Conn, buf[:n]); err != nil {
+		return nil, err
+	}
+	return buf[:n], nil
 }
 
+// frame copies the message as it is sent over the connection.
+func (d dnsResponseWriter) frame(msg []byte) []byte {
+	if !d.tcp {
+		return append([]byte(nil), msg...)
+	}
+
+	framed := make([]byte, 2+len(msg))
+	binary.BigEndian.PutUint16(framed, uint16(len(msg)))
+	copy(framed[2:], msg)
+	return framed
+}
+
+// WriteMsg writes the message prefixed with its length over TCP, or
+// truncates it to the size the client accepts over UDP.
 func (d dnsResponseWriter) WriteMsg(msg *dns.Msg) error {
+	if !d.tcp {
+		msg.Truncate(d.size)
+	}
+
 	data, err := msg.Pack()
 	if err != nil {
 		return err
 	}
 
-	_, err = d.Conn.Write(data)
+	_, err = d.Conn.Write(d.frame(data))
 	return err
 }
 
@@ -0,0 +1,202 @@
+package dns
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+type mxHandler struct{}
+
+func (mxHandler) Lookup(string) ([]net.IP, time.Time) {
+	return nil, time.Now()
+}
+
+func (mxHandler) Exchange(m *dns.Msg) (*dns.Msg, error) {
+	r := new(dns.Msg)
+	r.SetReply(m)
+	r.Id = 0
+	rr, err := dns.NewRR(m.Question[0].Name + " 60 IN MX 10 mail.example.com.")
+	r.Answer = append(r.Answer, rr)
+	return r, err
+}
+
+func (mxHandler) String() string {
+	return "MX"
+}
+
+type msgWriter struct {
+	dnsResponseWriter
+	msg *dns.Msg
+}
+
+func (w *msgWriter) WriteMsg(m *dns.Msg) error {
+	w.msg = m
+	return nil
+}
+
+func TestHijacker(t *testing.T) {
+	h, err := NewHijacker("198.18.0.0/16", ModeFakeIP, mxHandler{})
+	require.NoError(t, err)
+
+	ask := func(name string, qtype uint16) *dns.Msg {
+		m := new(dns.Msg)
+		m.SetQuestion(name, qtype)
+		w := new(msgWriter)
+		h.ServeDNS(w, m)
+		require.Equal(t, m.Id, w.msg.Id)
+		return w.msg
+	}
+
+	r := ask("example.com.", dns.TypeA)
+	require.Len(t, r.Answer, 1)
+	ip := r.Answer[0].(*dns.A).A
+	require.True(t, h.pool.contains(ip))
+
+	r = ask("example.com.", dns.TypeAAAA)
+	require.Equal(t, dns.RcodeSuccess, r.Rcode)
+	require.Empty(t, r.Answer)
+
+	name, err := dns.ReverseAddr(ip.String())
+	require.NoError(t, err)
+	r = ask(name, dns.TypePTR)
+	require.Len(t, r.Answer, 1)
+	require.Equal(t, "example.com.", r.Answer[0].(*dns.PTR).Ptr)
+
+	r = ask("255.255.18.198.in-addr.arpa.", dns.TypePTR)
+	require.Equal(t, dns.RcodeNameError, r.Rcode)
+
+	r = ask("example.com.", dns.TypeMX)
+	require.Len(t, r.Answer, 1)
+	require.Equal(t, "mail.example.com.", r.Answer[0].(*dns.MX).Mx)
+}
+
+// aHandler answers A and AAAA questions with the same addresses of their
+// family.
+type aHandler []string
+
+func (aHandler) Lookup(string) ([]net.IP, time.Time) {
+	return nil, time.Now()
+}
+
+func (h aHandler) Exchange(m *dns.Msg) (*dns.Msg, error) {
+	r := new(dns.Msg)
+	r.SetReply(m)
+	for _, ip := range h {
+		typ := "A"
+		if net.ParseIP(ip).To4() == nil {
+			typ = "AAAA"
+		}
+		if typ != dns.TypeToString[m.Question[0].Qtype] {
+			continue
+		}
+		rr, err := dns.NewRR(m.Question[0].Name + " 60 IN " + typ + " " + ip)
+		if err != nil {
+			return nil, err
+		}
+		r.Answer = append(r.Answer, rr)
+	}
+	return r, nil
+}
+
+func (aHandler) String() string {
+	return "A"
+}
+
+func TestHijackerRealIP(t *testing.T) {
+	h, err := NewHijacker("198.18.0.0/16", ModeRealIP, aHandler{"93.184.216.34", "93.184.216.35", "2606:2800:220:1::248"})
+	require.NoError(t, err)
+
+	ask := func(name string, qtype uint16) *dns.Msg {
+		m := new(dns.Msg)
+		m.SetQuestion(name, qtype)
+		w := new(msgWriter)
+		h.ServeDNS(w, m)
+		require.Equal(t, m.Id, w.msg.Id)
+		return w.msg
+	}
+
+	r := ask("example.com.", dns.TypeA)
+	require.Len(t, r.Answer, 2)
+	require.Equal(t, "93.184.216.34", r.Answer[0].(*dns.A).A.String())
+
+	host, ok := h.Domain(net.ParseIP("93.184.216.35"))
+	require.True(t, ok)
+	require.Equal(t, "example.com", host)
+	_, ok = h.ReverseLookup(net.ParseIP("93.184.216.35"))
+	require.False(t, ok)
+
+	ask("example.org.", dns.TypeA)
+	host, ok = h.Domain(net.ParseIP("93.184.216.34"))
+	require.True(t, ok)
+	require.Equal(t, "example.org", host)
+
+	r = ask("example.net.", dns.TypeAAAA)
+	require.Len(t, r.Answer, 1)
+	require.Equal(t, "2606:2800:220:1::248", r.Answer[0].(*dns.AAAA).AAAA.String())
+	host, ok = h.Domain(net.ParseIP("2606:2800:220:1::248"))
+	require.True(t, ok)
+	require.Equal(t, "example.net", host)
+}
+
+type addrConn struct {
+	net.Conn
+	remote net.Addr
+}
+
+func (c addrConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+func TestHijackTCP(t *testing.T) {
+	h, err := NewHijacker("198.18.0.0/16", ModeFakeIP, mxHandler{})
+	require.NoError(t, err)
+
+	client, server := net.Pipe()
+	defer client.Close()
+	go h.TryHijack(addrConn{Conn: server, remote: &net.TCPAddr{IP: net.IPv4(1, 1, 1, 1), Port: 53}})
+
+	conn := &dns.Conn{Conn: client}
+	for _, host := range []string{"a.example.com.", "b.example.com."} {
+		m := new(dns.Msg)
+		m.SetQuestion(host, dns.TypeA)
+		require.NoError(t, conn.WriteMsg(m))
+
+		r, err := conn.ReadMsg()
+		require.NoError(t, err)
+		require.Equal(t, m.Id, r.Id)
+		require.Len(t, r.Answer, 1)
+	}
+}
+
+func TestHijackUDPTruncation(t *testing.T) {
+	m := new(dns.Msg)
+	m.SetQuestion("example.com.", dns.TypeA)
+	r := new(dns.Msg)
+	r.SetReply(m)
+	for i := 0; i < 64; i++ {
+		r.Answer = append(r.Answer, &dns.A{
+			Hdr: dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeA, Class: dns.ClassINET},
+			A:   net.IPv4(1, 1, 1, byte(i)),
+		})
+	}
+
+	client, server := net.Pipe()
+	defer client.Close()
+	go func() {
+		w := dnsResponseWriter{Conn: server, size: udpSize(m)}
+		w.WriteMsg(r)
+	}()
+
+	buf := make([]byte, dns.MaxMsgSize)
+	n, err := client.Read(buf)
+	require.NoError(t, err)
+	require.LessOrEqual(t, n, dns.MinMsgSize)
+
+	truncated := new(dns.Msg)
+	require.NoError(t, truncated.Unpack(buf[:n]))
+	require.True(t, truncated.Truncated)
+}
@@ -1,13 +1,19 @@
 package dns
 
 import (
+	"errors"
 	"fmt"
 	"net"
+	"strings"
 	"time"
 
 	_ "unsafe"
+
+	"github.com/miekg/dns"
 )
 
+var errNotInHosts = errors.New("not in hosts")
+
 type HandlerOverHost struct {
 	ttl uint32
 }
@@ -18,13 +24,48 @@ func NewHandlerOverHost(ttl uint32) HandlerOverHost {
 	}
 }
 
-func (h HandlerOverHost) Lookup(host string) (net.IP, time.Time) {
-	res := goLookupIPFiles(host)
-	if len(res) == 0 {
-		return nil, time.Now()
+func (h HandlerOverHost) Lookup(host string) ([]net.IP, time.Time) {
+	var ips []net.IP
+	for _, addr := range goLookupIPFiles(host) {
+		ips = append(ips, addr.IP)
+	}
+	return ips, time.Now().Add(time.Duration(h.ttl) * time.Second)
+}
+
+// Exchange answers A and AAAA questions of the hosts in the hosts file with
+// their addresses of the same family.
+func (h HandlerOverHost) Exchange(m *dns.Msg) (*dns.Msg, error) {
+	if len(m.Question) == 0 {
+		return nil, errNotInHosts
 	}
 
-	return res[0].IP, time.Now()
+	question := m.Question[0]
+	if question.Qtype != dns.TypeA && question.Qtype != dns.TypeAAAA {
+		return nil, errNotInHosts
+	}
+
+	addrs := goLookupIPFiles(strings.TrimRight(question.Name, "."))
+	if len(addrs) == 0 {
+		return nil, errNotInHosts
+	}
+
+	var answer []dns.RR
+	hdr := dns.RR_Header{Name: question.Name, Rrtype: question.Qtype, Class: dns.ClassINET, Ttl: h.ttl}
+	for _, addr := range addrs {
+		ip4 := addr.IP.To4()
+		if question.Qtype == dns.TypeA && ip4 != nil {
+			answer = append(answer, &dns.A{Hdr: hdr, A: ip4})
+		}
+		if question.Qtype == dns.TypeAAAA && ip4 == nil {
+			answer = append(answer, &dns.AAAA{Hdr: hdr, AAAA: addr.IP})
+		}
+	}
+	r := new(dns.Msg)
+	r.SetReply(m)
+	r.Authoritative = true
+	r.RecursionAvailable = true
+	r.Answer = answer
+	return r, nil
 }
 
 func (h HandlerOverHost) String() string {
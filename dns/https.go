@@ -3,29 +3,49 @@ package dns
 import (
 	"bytes"
 	"context"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"net"
 	"net/http"
 	"net/url"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/fanpei91/spn/utils"
+	"github.com/miekg/dns"
 )
 
 type Handler interface {
-	Lookup(host string) (net.IP, time.Time)
+	Lookup(host string) ([]net.IP, time.Time)
+	Exchange(m *dns.Msg) (*dns.Msg, error)
 	String() string
 }
 
 const (
-	DefaultDNSOverHTTPSProvider = "rubyfish.cn:443"
+	DefaultDNSOverHTTPSProvider = "https://1.1.1.1/dns-query"
+
+	FormatWire = "wire"
+	FormatJSON = "json"
+
+	mimeDNSMessage = "application/dns-message"
+	mimeDNSJSON    = "application/dns-json"
 )
 
+var errBadStatus = errors.New("bad http status")
+
+// HandlerOverHTTPS speaks RFC 8484 wire format through GET or POST, or the
+// JSON flavor of Google and Cloudflare. The provider is a URL, of which an
+// RFC 6570 {?dns} or {?name,type} template suffix is optional.
 type HandlerOverHTTPS struct {
 	client    *http.Client
 	provider  string
+	format    string
+	method    string
 	proxy     Proxy
 	staticTTL time.Duration
 	timeout   time.Duration
@@ -33,10 +53,24 @@ type HandlerOverHTTPS struct {
 
 type Proxy func(*http.Request) (*url.URL, error)
 
-func NewHandlerOverHTTPS(staticTTL time.Duration, provider string, upstreamToLookupProvider string, timeout time.Duration, proxy Proxy, proxyHeader http.Header) *HandlerOverHTTPS {
+type ProxyHeader func(target string) http.Header
+
+func NewHandlerOverHTTPS(staticTTL time.Duration, provider, format, method string, upstreamToLookupProvider string, timeout time.Duration, proxy Proxy, proxyHeader ProxyHeader) *HandlerOverHTTPS {
+	if i := strings.Index(provider, "{"); i >= 0 {
+		provider = provider[:i]
+	}
+	if format == "" {
+		format = FormatWire
+	}
+	if format == FormatJSON || method == "" {
+		method = http.MethodGet
+	}
+
 	handler := &HandlerOverHTTPS{
 		staticTTL: staticTTL,
 		provider:  provider,
+		format:    format,
+		method:    strings.ToUpper(method),
 		proxy:     proxy,
 		timeout:   timeout,
 		client:    utils.HTTPClient(timeout, proxy, proxyHeader, upstreamToLookupProvider),
@@ -44,90 +78,215 @@ func NewHandlerOverHTTPS(staticTTL time.Duration, provider string, upstreamToLoo
 	return handler
 }
 
-func (h *HandlerOverHTTPS) Lookup(host string) (ip net.IP, expriedAt time.Time) {
-	provider := fmt.Sprintf("https://rubyfish.cn/dns-query?name=%s&type=A", host)
-	req, _ := http.NewRequest(http.MethodGet, provider, nil)
-	req.Header.Set("Accept", "application/dns-json")
+func (h *HandlerOverHTTPS) Lookup(host string) ([]net.IP, time.Time) {
+	ips, ttl := lookup(h.Exchange, host)
+	return ips, time.Now().Add(time.Duration(ttl) * time.Second)
+}
 
+func (h *HandlerOverHTTPS) Exchange(m *dns.Msg) (*dns.Msg, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), h.timeout)
 	defer cancel()
-	req = req.WithContext(ctx)
 
-	res, err := h.client.Do(req)
-	if res != nil {
-		defer res.Body.Close()
+	var r *dns.Msg
+	var err error
+	if h.format == FormatJSON {
+		r, err = h.exchangeJSON(ctx, m)
+	} else {
+		r, err = h.exchangeWire(ctx, m)
 	}
+
+	if err == nil && h.staticTTL != 0 {
+		for _, rr := range r.Answer {
+			rr.Header().Ttl = uint32(h.staticTTL / time.Second)
+		}
+	}
+	return r, err
+}
+
+func (h *HandlerOverHTTPS) exchangeWire(ctx context.Context, m *dns.Msg) (*dns.Msg, error) {
+	// The ID is always 0 to be friendly to the HTTP caches, see RFC 8484 4.1.
+	query := m.Copy()
+	query.Id = 0
+	data, err := query.Pack()
 	if err != nil {
-		return nil, time.Now()
+		return nil, err
+	}
+
+	var req *http.Request
+	if h.method == http.MethodPost {
+		req, err = http.NewRequestWithContext(ctx, http.MethodPost, h.provider, bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", mimeDNSMessage)
+	} else {
+		u := h.provider + separator(h.provider) + "dns=" + base64.RawURLEncoding.EncodeToString(data)
+		if req, err = http.NewRequestWithContext(ctx, http.MethodGet, u, nil); err != nil {
+			return nil, err
+		}
 	}
+	req.Header.Set("Accept", mimeDNSMessage)
 
-	buf, err := ioutil.ReadAll(res.Body)
+	buf, err := h.do(req)
 	if err != nil {
-		return nil, time.Now()
+		return nil, err
 	}
 
-	rr := &response{}
-	json.NewDecoder(bytes.NewBuffer(buf)).Decode(rr)
-	if rr.Status != 0 {
-		return nil, time.Now()
+	r := new(dns.Msg)
+	if err := r.Unpack(buf); err != nil {
+		return nil, err
 	}
-	if len(rr.Answer) == 0 {
-		return nil, time.Now()
+	r.Id = m.Id
+	return r, nil
+}
+
+func (h *HandlerOverHTTPS) exchangeJSON(ctx context.Context, m *dns.Msg) (*dns.Msg, error) {
+	if len(m.Question) == 0 {
+		return nil, errors.New("no question")
 	}
+	q := m.Question[0]
 
-	var answer *answer
-	for _, a := range rr.Answer {
-		if a.Type == typeIPv4 || a.Type == typeIPv6 {
-			answer = &a
-			break
-		}
+	u := h.provider + separator(h.provider) + url.Values{
+		"name": []string{q.Name},
+		"type": []string{strconv.Itoa(int(q.Qtype))},
+	}.Encode()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
 	}
+	req.Header.Set("Accept", mimeDNSJSON)
 
-	if answer != nil {
-		ip = net.ParseIP(answer.Data)
-		expriedAt = time.Now().Add(time.Duration(answer.TTL) * time.Second)
-		if h.staticTTL != 0 {
-			expriedAt = time.Now().Add(h.staticTTL)
-		}
+	buf, err := h.do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	rr := &response{}
+	if err := json.Unmarshal(buf, rr); err != nil {
+		return nil, err
 	}
 
-	return ip, expriedAt
+	r := new(dns.Msg)
+	r.SetReply(m)
+	r.Rcode = rr.Status
+	r.Truncated = rr.TC
+	r.RecursionAvailable = rr.RA
+	r.AuthenticatedData = rr.AD
+	r.Answer = rr.Answer.records()
+	r.Ns = rr.Authority.records()
+	return r, nil
+}
+
+func (h *HandlerOverHTTPS) do(req *http.Request) ([]byte, error) {
+	res, err := h.client.Do(req)
+	if res != nil {
+		defer res.Body.Close()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%w: %s", errBadStatus, res.Status)
+	}
+
+	return ioutil.ReadAll(res.Body)
 }
 
 func (h *HandlerOverHTTPS) String() string {
 	return fmt.Sprintf(
-		"HTTPS[upstream:%s, proxy enabled: %v, timeout: %v, ttl: %d]",
+		"HTTPS[upstream:%s, format: %s, proxy enabled: %v, timeout: %v, ttl: %d]",
 		h.provider,
+		h.format,
 		h.proxy != nil,
 		h.timeout,
 		h.staticTTL/time.Second,
 	)
 }
 
-const (
-	typeIPv4 = 1
-	typeIPv6 = 28
-)
+func separator(u string) string {
+	if strings.Contains(u, "?") {
+		return "&"
+	}
+	return "?"
+}
+
+// lookup asks for the IPv4 and IPv6 addresses of the host at once, and
+// returns them the former first, with the lowest TTL of them.
+func lookup(exchange func(m *dns.Msg) (*dns.Msg, error), host string) ([]net.IP, uint32) {
+	qtypes := []uint16{dns.TypeA, dns.TypeAAAA}
+	answers := make([]*dns.Msg, len(qtypes))
+
+	var wg sync.WaitGroup
+	for i, qtype := range qtypes {
+		wg.Add(1)
+		go func(i int, qtype uint16) {
+			defer wg.Done()
+
+			m := new(dns.Msg)
+			m.SetQuestion(dns.Fqdn(host), qtype)
+			if r, err := exchange(m); err == nil && r.Rcode == dns.RcodeSuccess {
+				answers[i] = r
+			}
+		}(i, qtype)
+	}
+	wg.Wait()
+
+	var ips []net.IP
+	var ttl uint32
+	for _, r := range answers {
+		if r == nil {
+			continue
+		}
+		for _, rr := range r.Answer {
+			var ip net.IP
+			switch a := rr.(type) {
+			case *dns.A:
+				ip = a.A
+			case *dns.AAAA:
+				ip = a.AAAA
+			default:
+				continue
+			}
+			if len(ips) == 0 || rr.Header().Ttl < ttl {
+				ttl = rr.Header().Ttl
+			}
+			ips = append(ips, ip)
+		}
+	}
+	return ips, ttl
+}
 
 type answer struct {
-	Type int    `json:"type"`
-	TTL  int    `json:"TTL"`
+	Name string `json:"name"`
+	Type uint16 `json:"type"`
+	TTL  uint32 `json:"TTL"`
 	Data string `json:"data"`
-	ip   net.IP
 }
 
-type response struct {
-	Status int      `json:"Status"`
-	Answer []answer `json:"Answer"`
-}
+type answers []answer
 
-type answerCache struct {
-	ip        net.IP
-	expiredAt time.Time
+func (a answers) records() []dns.RR {
+	var records []dns.RR
+	for _, an := range a {
+		typ, ok := dns.TypeToString[an.Type]
+		if !ok {
+			continue
+		}
+		rr, err := dns.NewRR(fmt.Sprintf("%s %d IN %s %s", dns.Fqdn(an.Name), an.TTL, typ, an.Data))
+		if err != nil || rr == nil {
+			continue
+		}
+		records = append(records, rr)
+	}
+	return records
 }
 
-type dnsResolver struct {
-	waiters  []chan answerCache
-	answer   answerCache
-	finished bool
+type response struct {
+	Status    int     `json:"Status"`
+	TC        bool    `json:"TC"`
+	RA        bool    `json:"RA"`
+	AD        bool    `json:"AD"`
+	Answer    answers `json:"Answer"`
+	Authority answers `json:"Authority"`
 }
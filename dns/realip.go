@@ -0,0 +1,66 @@
+package dns
+
+import (
+	"container/list"
+	"net"
+	"sync"
+)
+
+// realIPCapacity is as many addresses as a fake IP range of /16 has.
+const realIPCapacity = 1 << 16
+
+// realIPTable remembers the domains the real IPs are answered for, so that
+// the connections to them are still routed by domain. An address shared by
+// many domains, e.g. of a CDN, is taken for the one it was answered for
+// last, which is most likely the one being connected to. The least recently
+// used addresses are forgotten beyond the capacity.
+type realIPTable struct {
+	mutex    sync.Mutex
+	capacity int
+	lru      *list.List
+	ips      map[string]*list.Element
+}
+
+type realIP struct {
+	ip   string
+	host string
+}
+
+func newRealIPTable(capacity int) *realIPTable {
+	return &realIPTable{
+		capacity: capacity,
+		lru:      list.New(),
+		ips:      make(map[string]*list.Element),
+	}
+}
+
+func (t *realIPTable) add(host string, ips []net.IP) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	for _, ip := range ips {
+		key := string(ip.To16())
+		if e, ok := t.ips[key]; ok {
+			e.Value.(*realIP).host = host
+			t.lru.MoveToFront(e)
+			continue
+		}
+
+		t.ips[key] = t.lru.PushFront(&realIP{ip: key, host: host})
+		if t.lru.Len() > t.capacity {
+			delete(t.ips, t.lru.Remove(t.lru.Back()).(*realIP).ip)
+		}
+	}
+}
+
+func (t *realIPTable) lookup(ip net.IP) (string, bool) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	e, ok := t.ips[string(ip.To16())]
+	if !ok {
+		return "", false
+	}
+	t.lru.MoveToFront(e)
+	return e.Value.(*realIP).host, true
+}
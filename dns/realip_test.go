@@ -0,0 +1,30 @@
+package dns
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRealIPTable(t *testing.T) {
+	table := newRealIPTable(3)
+
+	a, b, c, d := net.ParseIP("1.1.1.1"), net.ParseIP("2.2.2.2"), net.ParseIP("3.3.3.3"), net.ParseIP("4.4.4.4")
+	table.add("a.com", []net.IP{a, b})
+	table.add("b.com", []net.IP{b.To4()})
+
+	host, ok := table.lookup(a)
+	require.True(t, ok)
+	require.Equal(t, "a.com", host)
+	host, ok = table.lookup(b)
+	require.True(t, ok)
+	require.Equal(t, "b.com", host)
+
+	table.add("c.com", []net.IP{c, d})
+	_, ok = table.lookup(a)
+	require.False(t, ok)
+	host, ok = table.lookup(d)
+	require.True(t, ok)
+	require.Equal(t, "c.com", host)
+}
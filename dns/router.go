@@ -0,0 +1,110 @@
+package dns
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// HandlerOverRouter passes the queries to the handler of the longest
+// matching domain suffix, or to the fallback.
+type HandlerOverRouter struct {
+	routes   map[string]Handler
+	fallback Handler
+}
+
+func NewHandlerOverRouter(routes map[string]Handler, fallback Handler) *HandlerOverRouter {
+	return &HandlerOverRouter{
+		routes:   routes,
+		fallback: fallback,
+	}
+}
+
+// LoadRoutes reads the upstreams keyed by domain suffix from a file of
+// dnsmasq server lines, e.g. server=/cn/qq.com/114.114.114.114.
+func LoadRoutes(path string) (map[string]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	routes := make(map[string]string)
+	scanner := bufio.NewScanner(file)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Split(strings.TrimPrefix(line, "server="), "/")
+		if !strings.HasPrefix(line, "server=/") || len(fields) < 3 {
+			return nil, fmt.Errorf("%s:%d: invalid route %q", path, n, line)
+		}
+
+		upstream := fields[len(fields)-1]
+		if upstream == "" {
+			continue
+		}
+		for _, suffix := range fields[1 : len(fields)-1] {
+			if suffix = normalizeDomain(suffix); suffix != "" {
+				routes[suffix] = upstream
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return routes, nil
+}
+
+// ParseUpstream turns the dnsmasq address of a route upstream, i.e. IP,
+// IP#port or IP:port, into host:port.
+func ParseUpstream(upstream string) string {
+	if i := strings.IndexByte(upstream, '#'); i >= 0 {
+		return net.JoinHostPort(strings.Trim(upstream[:i], "[]"), upstream[i+1:])
+	}
+	if _, _, err := net.SplitHostPort(upstream); err != nil {
+		return net.JoinHostPort(strings.Trim(upstream, "[]"), "53")
+	}
+	return upstream
+}
+
+func (r *HandlerOverRouter) Lookup(host string) ([]net.IP, time.Time) {
+	return r.route(host).Lookup(host)
+}
+
+func (r *HandlerOverRouter) Exchange(m *dns.Msg) (*dns.Msg, error) {
+	if len(m.Question) == 0 {
+		return r.fallback.Exchange(m)
+	}
+	return r.route(m.Question[0].Name).Exchange(m)
+}
+
+func (r *HandlerOverRouter) String() string {
+	return fmt.Sprintf("ROUTER[routes: %d, fallback: %s]", len(r.routes), r.fallback)
+}
+
+func (r *HandlerOverRouter) route(host string) Handler {
+	host = normalizeDomain(host)
+	for {
+		if h, ok := r.routes[host]; ok {
+			return h
+		}
+		i := strings.IndexByte(host, '.')
+		if i < 0 {
+			return r.fallback
+		}
+		host = host[i+1:]
+	}
+}
+
+func normalizeDomain(domain string) string {
+	return strings.ToLower(strings.Trim(domain, "."))
+}
@@ -0,0 +1,61 @@
+package dns
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+type namedHandler string
+
+func (h namedHandler) Lookup(string) ([]net.IP, time.Time) {
+	return nil, time.Now()
+}
+
+func (h namedHandler) Exchange(*dns.Msg) (*dns.Msg, error) {
+	return nil, nil
+}
+
+func (h namedHandler) String() string {
+	return string(h)
+}
+
+func TestLoadRoutes(t *testing.T) {
+	file, err := ioutil.TempFile("", "routes")
+	require.NoError(t, err)
+	defer os.Remove(file.Name())
+
+	file.WriteString("# china\nserver=/cn/QQ.com./114.114.114.114\n\nserver=/corp.internal/10.0.0.1#5353\nserver=/local/\n")
+	file.Close()
+
+	routes, err := LoadRoutes(file.Name())
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{
+		"cn":            "114.114.114.114",
+		"qq.com":        "114.114.114.114",
+		"corp.internal": "10.0.0.1#5353",
+	}, routes)
+	require.Equal(t, "10.0.0.1:5353", ParseUpstream(routes["corp.internal"]))
+	require.Equal(t, "114.114.114.114:53", ParseUpstream(routes["cn"]))
+
+	require.Equal(t, "[::1]:5353", ParseUpstream("::1#5353"))
+	require.Equal(t, "[::1]:53", ParseUpstream("::1"))
+	require.Equal(t, "[::1]:5353", ParseUpstream("[::1]:5353"))
+}
+
+func TestHandlerOverRouter(t *testing.T) {
+	r := NewHandlerOverRouter(map[string]Handler{
+		"com":         namedHandler("com"),
+		"example.com": namedHandler("example"),
+	}, namedHandler("fallback"))
+
+	require.Equal(t, "example", r.route("www.Example.com.").String())
+	require.Equal(t, "example", r.route("example.com").String())
+	require.Equal(t, "com", r.route("notexample.com").String())
+	require.Equal(t, "fallback", r.route("example.org").String())
+}
@@ -0,0 +1,273 @@
+package dns
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Mode is what the hijacker answers A questions with, the fake IPs of its
+// range or the real ones of the upstreams.
+type Mode string
+
+const (
+	ModeFakeIP Mode = "fake-ip"
+	ModeRealIP Mode = "real-ip"
+)
+
+const shutdownTimeout = 5 * time.Second
+
+func ParseMode(s string) (Mode, error) {
+	switch mode := Mode(s); mode {
+	case ModeFakeIP, ModeRealIP:
+		return mode, nil
+	}
+	return "", fmt.Errorf("unknown DNS mode %s", s)
+}
+
+// Server serves DNS over UDP and TCP of the same address, over TLS, or over
+// HTTPS.
+type Server struct {
+	addr       net.Addr
+	servers    []*dns.Server
+	httpServer *http.Server
+}
+
+// ListenAndServe serves the handler on the address. The answers over UDP are
+// truncated to the size the queries advertise.
+func ListenAndServe(addr string, handler dns.Handler) (*Server, error) {
+	packetConn, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	listener, err := net.Listen("tcp", packetConn.LocalAddr().String())
+	if err != nil {
+		packetConn.Close()
+		return nil, err
+	}
+
+	return serve(
+		packetConn.LocalAddr(),
+		&dns.Server{PacketConn: packetConn, Handler: truncate(handler)},
+		&dns.Server{Listener: listener, Handler: handler},
+	)
+}
+
+// ListenAndServeTLS serves the handler over TLS of the address, as of RFC
+// 7858.
+func ListenAndServeTLS(addr string, config *tls.Config, handler dns.Handler) (*Server, error) {
+	listener, err := tls.Listen("tcp", addr, config)
+	if err != nil {
+		return nil, err
+	}
+	return serve(listener.Addr(), &dns.Server{Listener: listener, Net: "tcp-tls", Handler: handler})
+}
+
+// ListenAndServeHTTPS serves the handler over HTTPS of the address at
+// /dns-query, as of RFC 8484, or over HTTP behind a reverse proxy if config
+// is nil.
+func ListenAndServeHTTPS(addr string, config *tls.Config, handler dns.Handler) (*Server, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	if config != nil {
+		listener = tls.NewListener(listener, config)
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/dns-query", NewHTTPHandler(handler))
+	s := &Server{
+		addr:       listener.Addr(),
+		httpServer: &http.Server{Handler: mux},
+	}
+	go s.httpServer.Serve(listener)
+	return s, nil
+}
+
+func serve(addr net.Addr, servers ...*dns.Server) (*Server, error) {
+	s := &Server{addr: addr}
+	for i, server := range servers {
+		started := make(chan struct{})
+		errc := make(chan error, 1)
+		server.NotifyStartedFunc = func() { close(started) }
+		go func(server *dns.Server) {
+			errc <- server.ActivateAndServe()
+		}(server)
+
+		select {
+		case <-started:
+			s.servers = append(s.servers, server)
+		case err := <-errc:
+			s.Close()
+			for _, server := range servers[i:] {
+				if server.PacketConn != nil {
+					server.PacketConn.Close()
+				}
+				if server.Listener != nil {
+					server.Listener.Close()
+				}
+			}
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+func (s *Server) Addr() net.Addr {
+	return s.addr
+}
+
+// Close shuts the servers down, waiting at most shutdownTimeout for the
+// connections to be done, and returns the first error.
+func (s *Server) Close() (err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	for _, server := range s.servers {
+		if e := server.ShutdownContext(ctx); e != nil && err == nil {
+			err = e
+		}
+	}
+	if s.httpServer != nil {
+		if e := s.httpServer.Shutdown(ctx); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+func truncate(handler dns.Handler) dns.Handler {
+	return dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		handler.ServeDNS(udpResponseWriter{ResponseWriter: w, size: udpSize(r)}, r)
+	})
+}
+
+type udpResponseWriter struct {
+	dns.ResponseWriter
+	size int
+}
+
+func (w udpResponseWriter) WriteMsg(msg *dns.Msg) error {
+	msg.Truncate(w.size)
+	return w.ResponseWriter.WriteMsg(msg)
+}
+
+// HTTPHandler serves the DNS messages of the wire format by GET and POST.
+type HTTPHandler struct {
+	handler dns.Handler
+}
+
+func NewHTTPHandler(handler dns.Handler) *HTTPHandler {
+	return &HTTPHandler{handler: handler}
+}
+
+func (h *HTTPHandler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	var data []byte
+	var err error
+	switch req.Method {
+	case http.MethodGet:
+		data, err = base64.RawURLEncoding.DecodeString(req.URL.Query().Get("dns"))
+	case http.MethodPost:
+		if req.Header.Get("Content-Type") != mimeDNSMessage {
+			http.Error(rw, "unsupported content type", http.StatusUnsupportedMediaType)
+			return
+		}
+		data, err = ioutil.ReadAll(http.MaxBytesReader(rw, req.Body, dns.MaxMsgSize))
+	default:
+		http.Error(rw, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	query := new(dns.Msg)
+	if err == nil {
+		err = query.Unpack(data)
+	}
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w := &httpResponseWriter{req: req}
+	h.handler.ServeDNS(w, query)
+	if w.msg == nil {
+		http.Error(rw, "no answer", http.StatusBadGateway)
+		return
+	}
+
+	out, err := w.msg.Pack()
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	rw.Header().Set("Content-Type", mimeDNSMessage)
+	rw.Header().Set("Cache-Control", "max-age="+strconv.Itoa(int(minTTL(w.msg))))
+	rw.Write(out)
+}
+
+func minTTL(m *dns.Msg) uint32 {
+	var ttl uint32
+	first := true
+	for _, section := range [][]dns.RR{m.Answer, m.Ns} {
+		for _, rr := range section {
+			if first || rr.Header().Ttl < ttl {
+				ttl = rr.Header().Ttl
+				first = false
+			}
+		}
+	}
+	return ttl
+}
+
+type httpResponseWriter struct {
+	req *http.Request
+	msg *dns.Msg
+}
+
+func (w *httpResponseWriter) LocalAddr() net.Addr {
+	addr, _ := w.req.Context().Value(http.LocalAddrContextKey).(net.Addr)
+	return addr
+}
+
+func (w *httpResponseWriter) RemoteAddr() net.Addr {
+	addr, _ := net.ResolveTCPAddr("tcp", w.req.RemoteAddr)
+	return addr
+}
+
+func (w *httpResponseWriter) WriteMsg(msg *dns.Msg) error {
+	w.msg = msg
+	return nil
+}
+
+func (w *httpResponseWriter) Write(b []byte) (int, error) {
+	msg := new(dns.Msg)
+	if err := msg.Unpack(b); err != nil {
+		return 0, err
+	}
+	w.msg = msg
+	return len(b), nil
+}
+
+func (w *httpResponseWriter) Close() error {
+	return nil
+}
+
+func (w *httpResponseWriter) TsigStatus() error {
+	return nil
+}
+
+func (w *httpResponseWriter) TsigTimersOnly(bool) {
+}
+
+func (w *httpResponseWriter) Hijack() {
+}
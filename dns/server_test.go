@@ -0,0 +1,117 @@
+package dns
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestServer(t *testing.T) {
+	s, err := ListenAndServe("127.0.0.1:0", dns.HandlerFunc(func(w dns.ResponseWriter, m *dns.Msg) {
+		r := new(dns.Msg)
+		r.SetReply(m)
+		for i := 0; i < 64; i++ {
+			r.Answer = append(r.Answer, &dns.A{
+				Hdr: dns.RR_Header{Name: m.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+				A:   net.IPv4(1, 1, 1, byte(i)),
+			})
+		}
+		w.WriteMsg(r)
+	}))
+	require.NoError(t, err)
+	defer s.Close()
+
+	m := new(dns.Msg)
+	m.SetQuestion("example.com.", dns.TypeA)
+
+	r, _, err := (&dns.Client{Net: "udp"}).Exchange(m, s.Addr().String())
+	require.NoError(t, err)
+	require.True(t, r.Truncated)
+
+	r, _, err = (&dns.Client{Net: "tcp"}).Exchange(m, s.Addr().String())
+	require.NoError(t, err)
+	require.False(t, r.Truncated)
+	require.Len(t, r.Answer, 64)
+}
+
+func TestServerFailed(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	s, err := serve(listener.Addr(), &dns.Server{Listener: listener, Handler: dns.DefaultServeMux}, &dns.Server{})
+	require.Error(t, err)
+	require.Nil(t, s)
+
+	_, err = net.Dial("tcp", listener.Addr().String())
+	require.Error(t, err)
+}
+
+func TestServerTLS(t *testing.T) {
+	ts := httptest.NewTLSServer(nil)
+	defer ts.Close()
+
+	h, err := NewHijacker("198.18.0.0/16", ModeRealIP, mxHandler{})
+	require.NoError(t, err)
+	s, err := ListenAndServeTLS("127.0.0.1:0", ts.TLS, h)
+	require.NoError(t, err)
+	defer s.Close()
+
+	m := new(dns.Msg)
+	m.SetQuestion("example.com.", dns.TypeMX)
+	client := &dns.Client{Net: "tcp-tls", TLSConfig: ts.Client().Transport.(*http.Transport).TLSClientConfig}
+	r, _, err := client.Exchange(m, s.Addr().String())
+	require.NoError(t, err)
+	require.Equal(t, m.Id, r.Id)
+	require.Len(t, r.Answer, 1)
+	require.Equal(t, dns.TypeMX, r.Answer[0].Header().Rrtype)
+}
+
+func TestServerHTTPS(t *testing.T) {
+	h, err := NewHijacker("198.18.0.0/16", ModeRealIP, mxHandler{})
+	require.NoError(t, err)
+	s, err := ListenAndServeHTTPS("127.0.0.1:0", nil, h)
+	require.NoError(t, err)
+	defer s.Close()
+
+	m := new(dns.Msg)
+	m.SetQuestion("example.com.", dns.TypeMX)
+	data, err := m.Pack()
+	require.NoError(t, err)
+
+	u := "http://" + s.Addr().String() + "/dns-query"
+	get := func() (*http.Response, error) {
+		return http.Get(u + "?dns=" + base64.RawURLEncoding.EncodeToString(data))
+	}
+	post := func() (*http.Response, error) {
+		return http.Post(u, mimeDNSMessage, bytes.NewReader(data))
+	}
+
+	for _, do := range []func() (*http.Response, error){get, post} {
+		res, err := do()
+		require.NoError(t, err)
+		body, err := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		require.NoError(t, err)
+
+		require.Equal(t, http.StatusOK, res.StatusCode)
+		require.Equal(t, mimeDNSMessage, res.Header.Get("Content-Type"))
+		require.Equal(t, "max-age=60", res.Header.Get("Cache-Control"))
+
+		r := new(dns.Msg)
+		require.NoError(t, r.Unpack(body))
+		require.Equal(t, m.Id, r.Id)
+		require.Len(t, r.Answer, 1)
+	}
+
+	res, err := http.Post(u, "text/plain", bytes.NewReader(data))
+	require.NoError(t, err)
+	res.Body.Close()
+	require.Equal(t, http.StatusUnsupportedMediaType, res.StatusCode)
+}
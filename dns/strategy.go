@@ -0,0 +1,158 @@
+package dns
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Strategy is how the upstreams are asked.
+type Strategy string
+
+const (
+	// StrategySequential asks the upstreams one after another in the
+	// given order.
+	StrategySequential Strategy = "sequential"
+	// StrategyParallel asks all of the upstreams at once, the first valid
+	// answer wins.
+	StrategyParallel Strategy = "parallel"
+	// StrategyAdaptive asks the upstreams one after another, the ones
+	// answering more often and faster first.
+	StrategyAdaptive Strategy = "adaptive"
+)
+
+func ParseStrategy(s string) (Strategy, error) {
+	switch strategy := Strategy(s); strategy {
+	case StrategySequential, StrategyParallel, StrategyAdaptive:
+		return strategy, nil
+	}
+	return "", fmt.Errorf("unknown strategy %s", s)
+}
+
+// UpstreamStats is how an upstream has done, the latency is the moving
+// average of the answered queries.
+type UpstreamStats struct {
+	Upstream string
+	Queries  uint64
+	Failures uint64
+	Latency  time.Duration
+}
+
+func (s UpstreamStats) String() string {
+	return fmt.Sprintf("%s: %d queries, %d failures, %v latency", s.Upstream, s.Queries, s.Failures, s.Latency)
+}
+
+const statsWeight = 0.2
+
+type upstream struct {
+	Handler
+	mutex   sync.Mutex
+	stats   UpstreamStats
+	success float64
+}
+
+func newUpstream(handler Handler) *upstream {
+	return &upstream{
+		Handler: handler,
+		stats:   UpstreamStats{Upstream: handler.String()},
+		success: 1,
+	}
+}
+
+// ask calls the upstream with f, which tells whether the upstream answered.
+func (u *upstream) ask(f func(Handler) (interface{}, bool)) (interface{}, bool) {
+	start := time.Now()
+	v, ok := f(u.Handler)
+	latency := time.Since(start)
+
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+
+	u.stats.Queries++
+	u.success *= 1 - statsWeight
+	if !ok {
+		u.stats.Failures++
+		return v, false
+	}
+
+	u.success += statsWeight
+	if u.stats.Latency == 0 {
+		u.stats.Latency = latency
+	} else {
+		u.stats.Latency += time.Duration(statsWeight * float64(latency-u.stats.Latency))
+	}
+	return v, true
+}
+
+// score is the expected time to an answer, the lower the better.
+func (u *upstream) score() float64 {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+
+	success := u.success
+	if success < 0.01 {
+		success = 0.01
+	}
+	return float64(u.stats.Latency+time.Millisecond) / success
+}
+
+func (u *upstream) snapshot() UpstreamStats {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	return u.stats
+}
+
+// query asks the upstreams with f the way of the strategy, and returns the
+// first answer and the upstream of it.
+func query(strategy Strategy, upstreams []*upstream, f func(Handler) (interface{}, bool)) (interface{}, Handler, bool) {
+	if strategy == StrategyParallel && len(upstreams) > 1 {
+		return queryParallel(upstreams, f)
+	}
+
+	if strategy == StrategyAdaptive {
+		ordered := make([]*upstream, len(upstreams))
+		copy(ordered, upstreams)
+		scores := make(map[*upstream]float64, len(ordered))
+		for _, u := range ordered {
+			scores[u] = u.score()
+		}
+		sort.SliceStable(ordered, func(i, j int) bool {
+			return scores[ordered[i]] < scores[ordered[j]]
+		})
+		upstreams = ordered
+	}
+
+	var v interface{}
+	for _, u := range upstreams {
+		var ok bool
+		if v, ok = u.ask(f); ok {
+			return v, u.Handler, true
+		}
+	}
+	return v, nil, false
+}
+
+func queryParallel(upstreams []*upstream, f func(Handler) (interface{}, bool)) (interface{}, Handler, bool) {
+	type answer struct {
+		v        interface{}
+		upstream Handler
+		ok       bool
+	}
+
+	answers := make(chan answer, len(upstreams))
+	for _, u := range upstreams {
+		go func(u *upstream) {
+			v, ok := u.ask(f)
+			answers <- answer{v: v, upstream: u.Handler, ok: ok}
+		}(u)
+	}
+
+	var last answer
+	for range upstreams {
+		if last = <-answers; last.ok {
+			return last.v, last.upstream, true
+		}
+	}
+	return last.v, nil, false
+}
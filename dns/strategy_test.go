@@ -0,0 +1,69 @@
+package dns
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+type slowHandler struct {
+	name  string
+	delay time.Duration
+	ip    net.IP
+}
+
+func (h slowHandler) Lookup(string) ([]net.IP, time.Time) {
+	return nil, time.Now()
+}
+
+func (h slowHandler) Exchange(m *dns.Msg) (*dns.Msg, error) {
+	time.Sleep(h.delay)
+	if h.ip == nil {
+		return nil, errNoUpstream
+	}
+
+	r := new(dns.Msg)
+	r.SetReply(m)
+	if m.Question[0].Qtype != dns.TypeA {
+		return r, nil
+	}
+	r.Answer = append(r.Answer, &dns.A{
+		Hdr: dns.RR_Header{Name: m.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+		A:   h.ip,
+	})
+	return r, nil
+}
+
+func (h slowHandler) String() string {
+	return h.name
+}
+
+func TestStrategy(t *testing.T) {
+	stalled := slowHandler{name: "stalled", delay: 200 * time.Millisecond}
+	fast := slowHandler{name: "fast", ip: net.IPv4(1, 1, 1, 1)}
+
+	start := time.Now()
+	ips, _ := NewHandlerOverCache([]Handler{stalled, fast}, StrategyParallel).Lookup("example.com")
+	require.Len(t, ips, 1)
+	require.True(t, fast.ip.Equal(ips[0]))
+	require.Less(t, int64(time.Since(start)), int64(stalled.delay))
+
+	cache := NewHandlerOverCache([]Handler{stalled, fast}, StrategyAdaptive)
+	cache.Lookup("a.example.com")
+	start = time.Now()
+	ips, _ = cache.Lookup("b.example.com")
+	require.Len(t, ips, 1)
+	require.True(t, fast.ip.Equal(ips[0]))
+	require.Less(t, int64(time.Since(start)), int64(stalled.delay))
+
+	stats := cache.Stats()
+	require.Equal(t, UpstreamStats{Upstream: "stalled", Queries: 2, Failures: 2}, stats[0])
+	require.Equal(t, uint64(4), stats[1].Queries)
+	require.Equal(t, uint64(0), stats[1].Failures)
+
+	_, err := ParseStrategy("random")
+	require.Error(t, err)
+}
@@ -0,0 +1,261 @@
+package dns
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/Dreamacro/clash/common/pool"
+	"github.com/fanpei91/spn/dialer"
+	"github.com/miekg/dns"
+)
+
+var errConnClosed = errors.New("dns connection closed")
+
+type Dial func(ctx context.Context, network, addr string) (net.Conn, error)
+
+// HandlerOverTCP queries the upstream over DNS over TCP, or DNS over TLS as
+// of RFC 7858. The queries are pipelined over one connection which is reused
+// until the upstream closes it.
+type HandlerOverTCP struct {
+	upstream  string
+	tlsConfig *tls.Config
+	dial      Dial
+	timeout   time.Duration
+	mutex     sync.Mutex
+	conn      *pipelinedConn
+}
+
+func NewHandlerOverTCP(upstream string, timeout time.Duration, dial Dial) *HandlerOverTCP {
+	if dial == nil {
+		dial = dialDirect
+	}
+	return &HandlerOverTCP{
+		upstream: upstream,
+		dial:     dial,
+		timeout:  timeout,
+	}
+}
+
+func NewHandlerOverTLS(upstream, serverName string, timeout time.Duration, dial Dial) *HandlerOverTCP {
+	h := NewHandlerOverTCP(upstream, timeout, dial)
+	if serverName == "" {
+		serverName, _, _ = net.SplitHostPort(upstream)
+	}
+	h.tlsConfig = &tls.Config{ServerName: serverName}
+	return h
+}
+
+func dialDirect(ctx context.Context, network, addr string) (net.Conn, error) {
+	d, err := dialer.New()
+	if err != nil {
+		return nil, err
+	}
+	return d.DialContext(ctx, network, addr)
+}
+
+func (h *HandlerOverTCP) Lookup(host string) ([]net.IP, time.Time) {
+	ips, ttl := lookup(h.Exchange, host)
+	return ips, time.Now().Add(time.Duration(ttl) * time.Second)
+}
+
+func (h *HandlerOverTCP) Exchange(m *dns.Msg) (*dns.Msg, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), h.timeout)
+	defer cancel()
+
+	// A pipelined connection may be closed by the upstream while idle, in
+	// which case the query is sent again over a new one.
+	for retry := 0; ; retry++ {
+		conn, err := h.getConn(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		r, err := conn.exchange(ctx, m)
+		if err == errConnClosed && retry == 0 {
+			continue
+		}
+		return r, err
+	}
+}
+
+func (h *HandlerOverTCP) getConn(ctx context.Context) (*pipelinedConn, error) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	if h.conn != nil && !h.conn.isClosed() {
+		return h.conn, nil
+	}
+
+	conn, err := h.dial(ctx, "tcp", h.upstream)
+	if err != nil {
+		return nil, err
+	}
+
+	if h.tlsConfig != nil {
+		tlsConn := tls.Client(conn, h.tlsConfig)
+		if deadline, ok := ctx.Deadline(); ok {
+			conn.SetDeadline(deadline)
+		}
+		if err := tlsConn.Handshake(); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn.SetDeadline(time.Time{})
+		conn = tlsConn
+	}
+
+	h.conn = newPipelinedConn(conn)
+	return h.conn, nil
+}
+
+func (h *HandlerOverTCP) String() string {
+	protocol := "TCP"
+	if h.tlsConfig != nil {
+		protocol = "TLS"
+	}
+	return fmt.Sprintf("%s[upstream: %v, timeout: %v]", protocol, h.upstream, h.timeout)
+}
+
+type pipelinedConn struct {
+	conn    net.Conn
+	wmutex  sync.Mutex
+	mutex   sync.Mutex
+	pending map[uint16]chan *dns.Msg
+	closed  bool
+}
+
+func newPipelinedConn(conn net.Conn) *pipelinedConn {
+	c := &pipelinedConn{
+		conn:    conn,
+		pending: make(map[uint16]chan *dns.Msg),
+	}
+	go c.readLoop()
+	return c
+}
+
+func (c *pipelinedConn) isClosed() bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.closed
+}
+
+func (c *pipelinedConn) exchange(ctx context.Context, m *dns.Msg) (*dns.Msg, error) {
+	ch := make(chan *dns.Msg, 1)
+
+	c.mutex.Lock()
+	if c.closed {
+		c.mutex.Unlock()
+		return nil, errConnClosed
+	}
+	id := uint16(rand.Uint32())
+	for _, ok := c.pending[id]; ok; _, ok = c.pending[id] {
+		id++
+	}
+	c.pending[id] = ch
+	c.mutex.Unlock()
+
+	defer func() {
+		c.mutex.Lock()
+		delete(c.pending, id)
+		c.mutex.Unlock()
+	}()
+
+	query := m.Copy()
+	query.Id = id
+	if err := c.write(ctx, query); err != nil {
+		c.close()
+		return nil, errConnClosed
+	}
+
+	select {
+	case r, ok := <-ch:
+		if !ok {
+			return nil, errConnClosed
+		}
+		r.Id = m.Id
+		return r, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// write sends the query before the deadline of the context, past which the
+// stalled connection is closed along with the queries queued on it. The
+// deadline is cleared after, as the connection is kept for the next ones.
+func (c *pipelinedConn) write(ctx context.Context, m *dns.Msg) error {
+	data, err := m.Pack()
+	if err != nil {
+		return err
+	}
+
+	buf := pool.Get(2 + len(data))
+	defer pool.Put(buf)
+	binary.BigEndian.PutUint16(buf, uint16(len(data)))
+	copy(buf[2:], data)
+
+	c.wmutex.Lock()
+	defer c.wmutex.Unlock()
+	if deadline, ok := ctx.Deadline(); ok {
+		c.conn.SetWriteDeadline(deadline)
+		defer c.conn.SetWriteDeadline(time.Time{})
+	}
+	_, err = c.conn.Write(buf)
+	return err
+}
+
+func (c *pipelinedConn) readLoop() {
+	defer c.close()
+
+	var length [2]byte
+	for {
+		if _, err := io.ReadFull(c.conn, length[:]); err != nil {
+			return
+		}
+
+		buf := pool.Get(int(binary.BigEndian.Uint16(length[:])))
+		_, err := io.ReadFull(c.conn, buf)
+		if err != nil {
+			pool.Put(buf)
+			return
+		}
+
+		r := new(dns.Msg)
+		err = r.Unpack(buf)
+		pool.Put(buf)
+		if err != nil {
+			continue
+		}
+
+		c.mutex.Lock()
+		ch, ok := c.pending[r.Id]
+		delete(c.pending, r.Id)
+		c.mutex.Unlock()
+
+		if ok {
+			ch <- r
+		}
+	}
+}
+
+func (c *pipelinedConn) close() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.closed {
+		return
+	}
+	c.closed = true
+	c.conn.Close()
+	for id, ch := range c.pending {
+		close(ch)
+		delete(c.pending, id)
+	}
+}
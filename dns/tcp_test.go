@@ -0,0 +1,59 @@
+package dns
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPipelinedConnStalledWrite(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+	c := newPipelinedConn(client)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	m := new(dns.Msg)
+	m.SetQuestion("example.com.", dns.TypeA)
+	_, err := c.exchange(ctx, m)
+	require.Equal(t, errConnClosed, err)
+	require.True(t, c.isClosed())
+}
+
+func TestPipelinedConnReused(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+	c := newPipelinedConn(client)
+
+	go func() {
+		conn := &dns.Conn{Conn: server}
+		for {
+			m, err := conn.ReadMsg()
+			if err != nil {
+				return
+			}
+			r := new(dns.Msg)
+			r.SetReply(m)
+			conn.WriteMsg(r)
+		}
+	}()
+
+	m := new(dns.Msg)
+	m.SetQuestion("example.com.", dns.TypeA)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	_, err := c.exchange(ctx, m)
+	require.NoError(t, err)
+
+	// The deadline of the query before is long past.
+	time.Sleep(50 * time.Millisecond)
+	_, err = c.exchange(context.Background(), m)
+	require.NoError(t, err)
+	require.False(t, c.isClosed())
+}
@@ -1,12 +1,12 @@
 package dns
 
 import (
-	"context"
 	"fmt"
 	"net"
 	"time"
 
 	"github.com/fanpei91/spn/dialer"
+	"github.com/miekg/dns"
 )
 
 type HandlerOverUDP struct {
@@ -21,27 +21,24 @@ func NewHandlerOverUDP(upstream string, timeout time.Duration) *HandlerOverUDP {
 	}
 }
 
-func (h *HandlerOverUDP) Lookup(host string) (ip net.IP, expriedAt time.Time) {
-	resolver := new(net.Resolver)
-	resolver.PreferGo = true
-	resolver.Dial = func(ctx context.Context, network, address string) (net.Conn, error) {
-		d, err := dialer.New()
-		if err != nil {
-			return nil, err
-		}
-
-		return d.DialContext(ctx, "udp", h.upstream)
-	}
+func (h *HandlerOverUDP) Lookup(host string) ([]net.IP, time.Time) {
+	ips, ttl := lookup(h.Exchange, host)
+	return ips, time.Now().Add(time.Duration(ttl) * time.Second)
+}
 
-	ctx, cancel := context.WithTimeout(context.Background(), h.timeout)
-	defer cancel()
-	ips, err := resolver.LookupIP(ctx, "ip", host)
-	expriedAt = time.Now()
+func (h *HandlerOverUDP) Exchange(m *dns.Msg) (*dns.Msg, error) {
+	d, err := dialer.New()
 	if err != nil {
-		return nil, expriedAt
+		return nil, err
 	}
 
-	return ips[0], expriedAt
+	c := &dns.Client{Net: "udp", Timeout: h.timeout, Dialer: d}
+	r, _, err := c.Exchange(m, h.upstream)
+	if err == nil && r.Truncated {
+		c.Net = "tcp"
+		r, _, err = c.Exchange(m, h.upstream)
+	}
+	return r, err
 }
 
 func (h *HandlerOverUDP) String() string {
@@ -1,6 +1,6 @@
 module github.com/fanpei91/spn
 
-go 1.15
+go 1.16
 
 require (
 	github.com/Dreamacro/clash v1.3.5
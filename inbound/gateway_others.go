@@ -0,0 +1,38 @@
+// +build !linux
+
+package inbound
+
+import (
+	"errors"
+	"net"
+)
+
+var errNotSupported = errors.New("not supported")
+
+type Redirect struct{}
+
+func ListenRedirect(addr string, handler Handler) (*Redirect, error) {
+	return nil, errNotSupported
+}
+
+func (r *Redirect) Addr() net.Addr {
+	return nil
+}
+
+func (r *Redirect) Close() error {
+	return errNotSupported
+}
+
+type TProxy struct{}
+
+func ListenTProxy(addr string, handler Handler) (*TProxy, error) {
+	return nil, errNotSupported
+}
+
+func (t *TProxy) Addr() net.Addr {
+	return nil
+}
+
+func (t *TProxy) Close() error {
+	return errNotSupported
+}
@@ -0,0 +1,105 @@
+package inbound
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// HTTP serves CONNECT, and the plain HTTP requests of the absolute URLs,
+// without authentication.
+type HTTP struct {
+	listener net.Listener
+	handler  Handler
+}
+
+func ListenHTTP(addr string, handler Handler) (*HTTP, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	h := &HTTP{
+		listener: listener,
+		handler:  handler,
+	}
+	go serve(listener, h.handle)
+	return h, nil
+}
+
+func (h *HTTP) Addr() net.Addr {
+	return h.listener.Addr()
+}
+
+func (h *HTTP) Close() error {
+	return h.listener.Close()
+}
+
+func (h *HTTP) handle(conn net.Conn) {
+	conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	r := bufio.NewReader(conn)
+	req, err := http.ReadRequest(r)
+	if err != nil {
+		logrus.Debugf("%s failed to read HTTP proxy request: %v", conn.RemoteAddr(), err)
+		conn.Close()
+		return
+	}
+	conn.SetDeadline(time.Time{})
+
+	if req.Method == http.MethodConnect {
+		if _, err := conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n")); err != nil {
+			conn.Close()
+			return
+		}
+		h.handler.HandleTCP(bufferedConn{Conn: conn, r: r}, withPort(req.URL.Host, "443"))
+		return
+	}
+
+	if req.URL.Host == "" || req.URL.Scheme != "http" {
+		conn.Write([]byte("HTTP/1.1 400 Bad Request\r\nConnection: close\r\n\r\n"))
+		conn.Close()
+		return
+	}
+
+	h.handler.HandleTCP(
+		bufferedConn{Conn: conn, r: io.MultiReader(originRequest(req), r)},
+		withPort(req.URL.Host, "80"),
+	)
+}
+
+// originRequest turns the head of the proxy request into the one to the
+// origin, which the body follows as it is. The origin closes the connection
+// after the response, so that the next request, which may be for another
+// host, comes as a new connection.
+func originRequest(req *http.Request) *bytes.Buffer {
+	header := req.Header.Clone()
+	for name := range header {
+		if strings.HasPrefix(strings.ToLower(name), "proxy-") {
+			header.Del(name)
+		}
+	}
+	header.Set("Connection", "close")
+	if len(req.TransferEncoding) != 0 {
+		header.Set("Transfer-Encoding", strings.Join(req.TransferEncoding, ", "))
+	}
+
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "%s %s HTTP/1.1\r\nHost: %s\r\n", req.Method, req.URL.RequestURI(), req.Host)
+	header.Write(&b)
+	b.WriteString("\r\n")
+	return &b
+}
+
+func withPort(host, port string) string {
+	if _, _, err := net.SplitHostPort(host); err == nil {
+		return host
+	}
+	return net.JoinHostPort(strings.Trim(host, "[]"), port)
+}
@@ -0,0 +1,92 @@
+package inbound
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestHTTPConnect(t *testing.T) {
+	handler := newEchoHandler()
+	h, err := ListenHTTP("127.0.0.1:0", handler)
+	require.NoError(t, err)
+	defer h.Close()
+
+	conn, err := net.Dial("tcp", h.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	fmt.Fprintf(conn, "CONNECT example.com:8443 HTTP/1.1\r\nHost: example.com:8443\r\n\r\nping")
+	r := bufio.NewReader(conn)
+	res, err := http.ReadResponse(r, nil)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	require.Equal(t, target{network: "tcp", addr: "example.com:8443"}, <-handler.targets)
+
+	buf := make([]byte, 4)
+	_, err = r.Read(buf)
+	require.NoError(t, err)
+	require.Equal(t, "ping", string(buf))
+}
+
+// originHandler answers the request with what the origin has received.
+type originHandler struct {
+	echoHandler
+}
+
+func (h *originHandler) HandleTCP(conn net.Conn, addr string) {
+	h.targets <- target{network: "tcp", addr: addr}
+	defer conn.Close()
+
+	req, err := http.ReadRequest(bufio.NewReader(conn))
+	if err != nil {
+		return
+	}
+	body, _ := ioutil.ReadAll(req.Body)
+
+	res := &http.Response{
+		StatusCode: http.StatusOK,
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Body: ioutil.NopCloser(strings.NewReader(fmt.Sprintf(
+			"%s %s %s %s %v %s",
+			req.Method,
+			req.RequestURI,
+			req.Host,
+			req.Header.Get("Proxy-Authorization"),
+			req.Close,
+			body,
+		))),
+		ContentLength: -1,
+		Close:         true,
+	}
+	res.Write(conn)
+}
+
+func TestHTTPForward(t *testing.T) {
+	handler := &originHandler{echoHandler: *newEchoHandler()}
+	h, err := ListenHTTP("127.0.0.1:0", handler)
+	require.NoError(t, err)
+	defer h.Close()
+
+	client := &http.Client{
+		Transport: &http.Transport{
+			Proxy: http.ProxyURL(&url.URL{Scheme: "http", User: url.UserPassword("u", "p"), Host: h.Addr().String()}),
+		},
+	}
+	res, err := client.Post("http://example.com/a?b=c", "text/plain", strings.NewReader("hello"))
+	require.NoError(t, err)
+	defer res.Body.Close()
+
+	body, err := ioutil.ReadAll(res.Body)
+	require.NoError(t, err)
+	require.Equal(t, "POST /a?b=c example.com  true hello", string(body))
+	require.Equal(t, target{network: "tcp", addr: "example.com:80"}, <-handler.targets)
+}
@@ -0,0 +1,42 @@
+package inbound
+
+import (
+	"io"
+	"net"
+	"time"
+)
+
+const handshakeTimeout = 10 * time.Second
+
+// Handler handles the connections accepted by the inbounds. The remote
+// address of a connection is the client, and target is the host:port it
+// asks for, the host of which is either a domain or an IP.
+type Handler interface {
+	HandleTCP(conn net.Conn, target string)
+	HandleUDP(conn net.Conn, target string)
+}
+
+// serve accepts the connections until the listener is closed.
+func serve(listener net.Listener, handle func(conn net.Conn)) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				time.Sleep(10 * time.Millisecond)
+				continue
+			}
+			return
+		}
+		go handle(conn)
+	}
+}
+
+// bufferedConn reads what is left in the reader of the handshake first.
+type bufferedConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
@@ -0,0 +1,42 @@
+package inbound
+
+import (
+	"io"
+	"net"
+	"time"
+)
+
+type target struct {
+	network string
+	addr    string
+}
+
+// echoHandler echoes back what the connections read.
+type echoHandler struct {
+	targets chan target
+}
+
+func newEchoHandler() *echoHandler {
+	return &echoHandler{targets: make(chan target, 8)}
+}
+
+func (h *echoHandler) HandleTCP(conn net.Conn, addr string) {
+	h.targets <- target{network: "tcp", addr: addr}
+	defer conn.Close()
+	io.Copy(conn, conn)
+}
+
+func (h *echoHandler) HandleUDP(conn net.Conn, addr string) {
+	h.targets <- target{network: "udp", addr: addr}
+	defer conn.Close()
+
+	buf := make([]byte, maxDatagramSize)
+	for {
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		n, err := conn.Read(buf)
+		if err != nil {
+			return
+		}
+		conn.Write(buf[:n])
+	}
+}
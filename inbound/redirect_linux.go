@@ -0,0 +1,105 @@
+// +build linux
+
+package inbound
+
+import (
+	"errors"
+	"net"
+	"syscall"
+	"unsafe"
+
+	"github.com/sirupsen/logrus"
+)
+
+// soOriginalDst is SO_ORIGINAL_DST, and IP6T_SO_ORIGINAL_DST as well.
+const soOriginalDst = 80
+
+// Redirect serves the TCP which iptables REDIRECT diverts, the original
+// destinations of which are told by SO_ORIGINAL_DST.
+type Redirect struct {
+	listener net.Listener
+	handler  Handler
+}
+
+func ListenRedirect(addr string, handler Handler) (*Redirect, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &Redirect{
+		listener: listener,
+		handler:  handler,
+	}
+	go serve(listener, r.handle)
+	return r, nil
+}
+
+func (r *Redirect) Addr() net.Addr {
+	return r.listener.Addr()
+}
+
+func (r *Redirect) Close() error {
+	return r.listener.Close()
+}
+
+func (r *Redirect) handle(conn net.Conn) {
+	target, err := originalDst(conn.(*net.TCPConn))
+	if err != nil {
+		logrus.Warnf("%s failed to get the original destination: %v", conn.RemoteAddr(), err)
+		conn.Close()
+		return
+	}
+	r.handler.HandleTCP(conn, target.String())
+}
+
+func originalDst(conn *net.TCPConn) (*net.TCPAddr, error) {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+
+	ipv6 := conn.LocalAddr().(*net.TCPAddr).IP.To4() == nil
+
+	var addr *net.TCPAddr
+	var sockErr error
+	err = raw.Control(func(fd uintptr) {
+		addr, sockErr = getOriginalDst(int(fd), ipv6)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return addr, sockErr
+}
+
+// getOriginalDst reads the sockaddr_in or sockaddr_in6 of the original
+// destination into the structs of the same or larger sizes, as syscall has
+// no getsockopt for them.
+func getOriginalDst(fd int, ipv6 bool) (*net.TCPAddr, error) {
+	if !ipv6 {
+		mreq, err := syscall.GetsockoptIPv6Mreq(fd, syscall.SOL_IP, soOriginalDst)
+		if err != nil {
+			return nil, err
+		}
+		// struct sockaddr_in: family, port, addr.
+		sa := mreq.Multiaddr
+		return &net.TCPAddr{
+			IP:   net.IPv4(sa[4], sa[5], sa[6], sa[7]),
+			Port: int(sa[2])<<8 | int(sa[3]),
+		}, nil
+	}
+
+	info, err := syscall.GetsockoptIPv6MTUInfo(fd, syscall.SOL_IPV6, soOriginalDst)
+	if err != nil {
+		return nil, err
+	}
+	sa := info.Addr
+	if sa.Family != syscall.AF_INET6 {
+		return nil, errors.New("not an IPv6 original destination")
+	}
+	port := (*[2]byte)(unsafe.Pointer(&sa.Port))
+	return &net.TCPAddr{
+		IP:   append(net.IP(nil), sa.Addr[:]...),
+		Port: int(port[0])<<8 | int(port[1]),
+	}, nil
+}
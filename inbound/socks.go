@@ -0,0 +1,189 @@
+package inbound
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/Dreamacro/clash/common/pool"
+	"github.com/Dreamacro/clash/component/socks5"
+	"github.com/sirupsen/logrus"
+)
+
+const maxDatagramSize = 64 * 1024
+
+var errInvalidAddr = errors.New("invalid address")
+
+// SOCKS5 serves CONNECT over TCP and UDP ASSOCIATE over UDP of the same
+// address, without authentication. The datagrams are relayed only for the
+// IPs of the clients associated.
+type SOCKS5 struct {
+	listener   net.Listener
+	packetConn net.PacketConn
+	handler    Handler
+	flows      *udpFlows
+
+	mutex        sync.Mutex
+	associations map[string]int
+}
+
+func ListenSOCKS5(addr string, handler Handler) (*SOCKS5, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	packetConn, err := net.ListenPacket("udp", listener.Addr().String())
+	if err != nil {
+		listener.Close()
+		return nil, err
+	}
+
+	s := &SOCKS5{
+		listener:   listener,
+		packetConn: packetConn,
+		handler:    handler,
+		flows:      newUDPFlows(),
+
+		associations: make(map[string]int),
+	}
+	go serve(listener, s.handle)
+	go s.serveUDP()
+	return s, nil
+}
+
+func (s *SOCKS5) Addr() net.Addr {
+	return s.listener.Addr()
+}
+
+func (s *SOCKS5) Close() error {
+	err := s.listener.Close()
+	s.packetConn.Close()
+	return err
+}
+
+func (s *SOCKS5) handle(conn net.Conn) {
+	// The client is associated during the handshake already, as it may send
+	// the datagrams as soon as UDP ASSOCIATE is answered.
+	ip := addrIP(conn.RemoteAddr())
+	s.associate(ip)
+
+	conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	target, command, err := socks5.ServerHandshake(conn, nil)
+	if err != nil {
+		logrus.Debugf("%s failed to handshake SOCKS5: %v", conn.RemoteAddr(), err)
+		conn.Close()
+		s.dissociate(ip)
+		return
+	}
+	conn.SetDeadline(time.Time{})
+
+	if command == socks5.CmdUDPAssociate {
+		// The association is kept until the client closes the connection,
+		// which closes its flows too.
+		io.Copy(ioutil.Discard, conn)
+		conn.Close()
+		s.dissociate(ip)
+		return
+	}
+
+	s.dissociate(ip)
+	s.handler.HandleTCP(conn, target.String())
+}
+
+func (s *SOCKS5) serveUDP() {
+	buf := pool.Get(maxDatagramSize)
+	defer pool.Put(buf)
+
+	for {
+		n, client, err := s.packetConn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+
+		if !s.associated(addrIP(client)) {
+			logrus.Debugf("%s drop SOCKS5 datagram: not associated", client)
+			continue
+		}
+
+		target, payload, err := socks5.DecodeUDPPacket(buf[:n])
+		if err != nil {
+			logrus.Debugf("%s drop SOCKS5 datagram: %v", client, err)
+			continue
+		}
+		s.dispatch(client, target, payload)
+	}
+}
+
+func (s *SOCKS5) associate(ip net.IP) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.associations[string(ip.To16())]++
+}
+
+// dissociate forgets an association of the IP, and closes its flows once
+// there are no more of them.
+func (s *SOCKS5) dissociate(ip net.IP) {
+	s.mutex.Lock()
+	key := string(ip.To16())
+	s.associations[key]--
+	last := s.associations[key] == 0
+	if last {
+		delete(s.associations, key)
+	}
+	s.mutex.Unlock()
+
+	if last {
+		s.flows.closeFrom(ip)
+	}
+}
+
+func (s *SOCKS5) associated(ip net.IP) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.associations[string(ip.To16())] > 0
+}
+
+// dispatch passes the payload to the flow of the client to the target, which
+// is handled as a connection when it's new.
+func (s *SOCKS5) dispatch(client net.Addr, target socks5.Addr, payload []byte) {
+	flow, created, _ := s.flows.get(client, target.String(), func() (*udpFlow, error) {
+		target := append(socks5.Addr(nil), target...)
+		return newUDPFlow(s.packetConn.LocalAddr(), client, func(b []byte) error {
+			return s.reply(client, target, b)
+		}, func(b []byte, from string) error {
+			return s.reply(client, socks5.ParseAddr(from), b)
+		}), nil
+	})
+
+	flow.push(payload)
+	if created {
+		go s.handler.HandleUDP(flow, target.String())
+	}
+}
+
+// reply sends the datagram to the client as if it were from the address.
+func (s *SOCKS5) reply(client net.Addr, from socks5.Addr, b []byte) error {
+	if from == nil {
+		return errInvalidAddr
+	}
+	packet, err := socks5.EncodeUDPPacket(from, b)
+	if err != nil {
+		return err
+	}
+	_, err = s.packetConn.WriteTo(packet, client)
+	return err
+}
+
+func addrIP(addr net.Addr) net.IP {
+	switch addr := addr.(type) {
+	case *net.TCPAddr:
+		return addr.IP
+	case *net.UDPAddr:
+		return addr.IP
+	}
+	return nil
+}
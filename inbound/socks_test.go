@@ -0,0 +1,154 @@
+package inbound
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/Dreamacro/clash/component/socks5"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSOCKS5Connect(t *testing.T) {
+	handler := newEchoHandler()
+	s, err := ListenSOCKS5("127.0.0.1:0", handler)
+	require.NoError(t, err)
+	defer s.Close()
+
+	conn, err := net.Dial("tcp", s.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	_, err = socks5.ClientHandshake(conn, socks5.ParseAddr("example.com:443"), socks5.CmdConnect, nil)
+	require.NoError(t, err)
+	require.Equal(t, target{network: "tcp", addr: "example.com:443"}, <-handler.targets)
+
+	_, err = conn.Write([]byte("ping"))
+	require.NoError(t, err)
+	buf := make([]byte, 4)
+	_, err = conn.Read(buf)
+	require.NoError(t, err)
+	require.Equal(t, "ping", string(buf))
+}
+
+func TestSOCKS5UDPAssociate(t *testing.T) {
+	handler := newEchoHandler()
+	s, err := ListenSOCKS5("127.0.0.1:0", handler)
+	require.NoError(t, err)
+	defer s.Close()
+
+	conn, err := net.Dial("tcp", s.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	bind, err := socks5.ClientHandshake(conn, socks5.ParseAddr("0.0.0.0:0"), socks5.CmdUDPAssociate, nil)
+	require.NoError(t, err)
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer pc.Close()
+
+	buf := make([]byte, maxDatagramSize)
+	for _, addr := range []string{"1.1.1.1:53", "example.com:53", "1.1.1.1:53"} {
+		packet, err := socks5.EncodeUDPPacket(socks5.ParseAddr(addr), []byte("ping "+addr))
+		require.NoError(t, err)
+		_, err = pc.WriteTo(packet, bind.UDPAddr())
+		require.NoError(t, err)
+
+		n, _, err := pc.ReadFrom(buf)
+		require.NoError(t, err)
+		from, payload, err := socks5.DecodeUDPPacket(buf[:n])
+		require.NoError(t, err)
+		require.Equal(t, addr, from.String())
+		require.Equal(t, "ping "+addr, string(payload))
+	}
+
+	require.Equal(t, target{network: "udp", addr: "1.1.1.1:53"}, <-handler.targets)
+	require.Equal(t, target{network: "udp", addr: "example.com:53"}, <-handler.targets)
+	require.Len(t, handler.targets, 0)
+}
+
+func TestSOCKS5UDPNotAssociated(t *testing.T) {
+	handler := newEchoHandler()
+	s, err := ListenSOCKS5("127.0.0.1:0", handler)
+	require.NoError(t, err)
+	defer s.Close()
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer pc.Close()
+
+	send := func() error {
+		packet, err := socks5.EncodeUDPPacket(socks5.ParseAddr("1.1.1.1:53"), []byte("ping"))
+		require.NoError(t, err)
+		_, err = pc.WriteTo(packet, s.packetConn.LocalAddr())
+		require.NoError(t, err)
+
+		pc.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+		_, _, err = pc.ReadFrom(make([]byte, maxDatagramSize))
+		return err
+	}
+
+	require.Error(t, send())
+
+	conn, err := net.Dial("tcp", s.Addr().String())
+	require.NoError(t, err)
+	_, err = socks5.ClientHandshake(conn, socks5.ParseAddr("0.0.0.0:0"), socks5.CmdUDPAssociate, nil)
+	require.NoError(t, err)
+	require.NoError(t, send())
+
+	conn.Close()
+	require.Eventually(t, func() bool {
+		s.flows.mutex.Lock()
+		defer s.flows.mutex.Unlock()
+		return len(s.flows.flows) == 0
+	}, time.Second, 10*time.Millisecond)
+	require.Error(t, send())
+}
+
+// flowHandler passes on the UDP flows.
+type flowHandler struct {
+	flows chan net.Conn
+}
+
+func (h flowHandler) HandleTCP(conn net.Conn, _ string) {
+	conn.Close()
+}
+
+func (h flowHandler) HandleUDP(conn net.Conn, _ string) {
+	h.flows <- conn
+}
+
+func TestSOCKS5UDPWriteFrom(t *testing.T) {
+	handler := flowHandler{flows: make(chan net.Conn, 1)}
+	s, err := ListenSOCKS5("127.0.0.1:0", handler)
+	require.NoError(t, err)
+	defer s.Close()
+
+	conn, err := net.Dial("tcp", s.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	bind, err := socks5.ClientHandshake(conn, socks5.ParseAddr("0.0.0.0:0"), socks5.CmdUDPAssociate, nil)
+	require.NoError(t, err)
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer pc.Close()
+	packet, err := socks5.EncodeUDPPacket(socks5.ParseAddr("1.1.1.1:3478"), []byte("binding"))
+	require.NoError(t, err)
+	_, err = pc.WriteTo(packet, bind.UDPAddr())
+	require.NoError(t, err)
+
+	flow := (<-handler.flows).(*udpFlow)
+	defer flow.Close()
+	_, err = flow.WriteFrom([]byte("punch"), "2.2.2.2:4000")
+	require.NoError(t, err)
+
+	buf := make([]byte, maxDatagramSize)
+	n, _, err := pc.ReadFrom(buf)
+	require.NoError(t, err)
+	from, payload, err := socks5.DecodeUDPPacket(buf[:n])
+	require.NoError(t, err)
+	require.Equal(t, "2.2.2.2:4000", from.String())
+	require.Equal(t, "punch", string(payload))
+}
@@ -0,0 +1,225 @@
+// +build linux
+
+package inbound
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"net"
+	"strings"
+	"syscall"
+
+	"github.com/Dreamacro/clash/common/pool"
+	"github.com/sirupsen/logrus"
+)
+
+// The options of IPv6 missing in syscall.
+const (
+	ipv6Transparent     = 0x4b
+	ipv6RecvOrigDstAddr = 0x4a
+)
+
+// TProxy serves the TCP and UDP which iptables TPROXY diverts to the same
+// address, the original destinations of which are kept by IP_TRANSPARENT.
+type TProxy struct {
+	listener   net.Listener
+	packetConn *net.UDPConn
+	handler    Handler
+	flows      *udpFlows
+}
+
+func ListenTProxy(addr string, handler Handler) (*TProxy, error) {
+	lc := net.ListenConfig{Control: transparent(false)}
+	listener, err := lc.Listen(context.Background(), "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	lc = net.ListenConfig{Control: transparent(true)}
+	packetConn, err := lc.ListenPacket(context.Background(), "udp", listener.Addr().String())
+	if err != nil {
+		listener.Close()
+		return nil, err
+	}
+
+	t := &TProxy{
+		listener:   listener,
+		packetConn: packetConn.(*net.UDPConn),
+		handler:    handler,
+		flows:      newUDPFlows(),
+	}
+	go serve(listener, t.handle)
+	go t.serveUDP()
+	return t, nil
+}
+
+func (t *TProxy) Addr() net.Addr {
+	return t.listener.Addr()
+}
+
+func (t *TProxy) Close() error {
+	err := t.listener.Close()
+	t.packetConn.Close()
+	return err
+}
+
+// handle handles the connection, which is accepted on behalf of its original
+// destination.
+func (t *TProxy) handle(conn net.Conn) {
+	t.handler.HandleTCP(conn, conn.LocalAddr().String())
+}
+
+func (t *TProxy) serveUDP() {
+	buf := pool.Get(maxDatagramSize)
+	defer pool.Put(buf)
+	oob := make([]byte, 1024)
+
+	for {
+		n, oobn, _, client, err := t.packetConn.ReadMsgUDP(buf, oob)
+		if err != nil {
+			return
+		}
+
+		target, err := origDst(oob[:oobn])
+		if err != nil {
+			logrus.Debugf("%s drop TPROXY datagram: %v", client, err)
+			continue
+		}
+		t.dispatch(client, target, buf[:n])
+	}
+}
+
+// dispatch passes the payload to the flow of the client to the target, which
+// is handled as a connection when it's new.
+func (t *TProxy) dispatch(client, target *net.UDPAddr, payload []byte) {
+	flow, created, err := t.flows.get(client, target.String(), func() (*udpFlow, error) {
+		return newTProxyFlow(client, target)
+	})
+	if err != nil {
+		logrus.Warnf("%s failed to reply udp://%s: %v", client, target, err)
+		return
+	}
+
+	flow.push(payload)
+	if created {
+		go t.handler.HandleUDP(flow, target.String())
+	}
+}
+
+// newTProxyFlow makes the flow replying from the socket of the target, which
+// isn't a local address. The datagrams of the client may come to that socket
+// instead of the inbound once it exists, so they are read from it as well.
+func newTProxyFlow(client, target *net.UDPAddr) (*udpFlow, error) {
+	d := net.Dialer{LocalAddr: target, Control: transparent(false)}
+	conn, err := d.Dial("udp", client.String())
+	if err != nil {
+		return nil, err
+	}
+
+	flow := newUDPFlow(target, client, func(b []byte) error {
+		_, err := conn.Write(b)
+		return err
+	}, func(b []byte, from string) error {
+		return replyFrom(client, from, b)
+	})
+	flow.onClose = append(flow.onClose, func() {
+		conn.Close()
+	})
+
+	go func() {
+		buf := pool.Get(maxDatagramSize)
+		defer pool.Put(buf)
+		for {
+			n, err := conn.Read(buf)
+			if err != nil {
+				return
+			}
+			flow.push(buf[:n])
+		}
+	}()
+	return flow, nil
+}
+
+// replyFrom sends the datagram to the client from the socket of the address,
+// which is made for it.
+func replyFrom(client *net.UDPAddr, from string, b []byte) error {
+	addr, err := net.ResolveUDPAddr("udp", from)
+	if err != nil {
+		return err
+	}
+	d := net.Dialer{LocalAddr: addr, Control: transparent(false)}
+	conn, err := d.Dial("udp", client.String())
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write(b)
+	return err
+}
+
+// transparent allows the socket to take the connections and datagrams to,
+// and to bind, the addresses which aren't local.
+func transparent(recvOrigDst bool) func(network, address string, c syscall.RawConn) error {
+	return func(network, address string, c syscall.RawConn) error {
+		var sockErr error
+		err := c.Control(func(fd uintptr) {
+			sockErr = setTransparent(int(fd), strings.HasSuffix(network, "6"), recvOrigDst)
+		})
+		if err != nil {
+			return err
+		}
+		return sockErr
+	}
+}
+
+func setTransparent(fd int, ipv6 bool, recvOrigDst bool) error {
+	if err := syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1); err != nil {
+		return err
+	}
+
+	// The IPv6 sockets take IPv4 as well, for which the options of IPv4 are
+	// set if they can.
+	level, opt, recv := syscall.SOL_IP, syscall.IP_TRANSPARENT, syscall.IP_RECVORIGDSTADDR
+	if ipv6 {
+		syscall.SetsockoptInt(fd, level, opt, 1)
+		if recvOrigDst {
+			syscall.SetsockoptInt(fd, level, recv, 1)
+		}
+		level, opt, recv = syscall.SOL_IPV6, ipv6Transparent, ipv6RecvOrigDstAddr
+	}
+
+	if err := syscall.SetsockoptInt(fd, level, opt, 1); err != nil {
+		return err
+	}
+	if recvOrigDst {
+		return syscall.SetsockoptInt(fd, level, recv, 1)
+	}
+	return nil
+}
+
+// origDst parses the original destination of the datagram from its control
+// messages, which carry a sockaddr_in or sockaddr_in6.
+func origDst(oob []byte) (*net.UDPAddr, error) {
+	msgs, err := syscall.ParseSocketControlMessage(oob)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, msg := range msgs {
+		data := msg.Data
+		switch {
+		case msg.Header.Level == syscall.SOL_IP && msg.Header.Type == syscall.IP_ORIGDSTADDR && len(data) >= syscall.SizeofSockaddrInet4:
+			return &net.UDPAddr{
+				IP:   net.IPv4(data[4], data[5], data[6], data[7]),
+				Port: int(binary.BigEndian.Uint16(data[2:4])),
+			}, nil
+		case msg.Header.Level == syscall.SOL_IPV6 && msg.Header.Type == ipv6RecvOrigDstAddr && len(data) >= syscall.SizeofSockaddrInet6:
+			return &net.UDPAddr{
+				IP:   append(net.IP(nil), data[8:24]...),
+				Port: int(binary.BigEndian.Uint16(data[2:4])),
+			}, nil
+		}
+	}
+	return nil, errors.New("no original destination")
+}
@@ -0,0 +1,70 @@
+// +build linux
+
+package inbound
+
+import (
+	"io"
+	"net"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// The datagrams and connections sent to the inbound directly look like those
+// diverted by TPROXY, whose original destination is the inbound itself.
+func TestTProxy(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("IP_TRANSPARENT needs CAP_NET_ADMIN")
+	}
+
+	handler := newEchoHandler()
+	tp, err := ListenTProxy("127.0.0.1:0", handler)
+	require.NoError(t, err)
+	defer tp.Close()
+	addr := tp.Addr().String()
+
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.Write([]byte("ping"))
+	require.NoError(t, err)
+	buf := make([]byte, 4)
+	_, err = io.ReadFull(conn, buf)
+	require.NoError(t, err)
+	require.Equal(t, "ping", string(buf))
+	require.Equal(t, target{network: "tcp", addr: addr}, <-handler.targets)
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer pc.Close()
+
+	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	require.NoError(t, err)
+	for _, payload := range []string{"ping", "pong"} {
+		_, err = pc.WriteTo([]byte(payload), udpAddr)
+		require.NoError(t, err)
+
+		n, from, err := pc.ReadFrom(buf)
+		require.NoError(t, err)
+		require.Equal(t, addr, from.String())
+		require.Equal(t, payload, string(buf[:n]))
+	}
+	require.Equal(t, target{network: "udp", addr: addr}, <-handler.targets)
+	require.Len(t, handler.targets, 0)
+}
+
+func TestRedirectWithoutNAT(t *testing.T) {
+	handler := newEchoHandler()
+	r, err := ListenRedirect("127.0.0.1:0", handler)
+	require.NoError(t, err)
+	defer r.Close()
+
+	conn, err := net.Dial("tcp", r.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	_, err = conn.Read(make([]byte, 1))
+	require.Error(t, err)
+	require.Len(t, handler.targets, 0)
+}
@@ -0,0 +1,176 @@
+package inbound
+
+import (
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+const flowBacklog = 64
+
+// udpFlow is the connection of the datagrams between a client and a target,
+// which the inbound reads from its UDP socket and pushes to the flow. The
+// replies are sent back to the client as if they were from the target, or
+// from the other peers.
+type udpFlow struct {
+	local     net.Addr
+	client    net.Addr
+	reply     func(b []byte) error
+	replyFrom func(b []byte, from string) error
+	packets   chan []byte
+	done      chan struct{}
+	closeOnce sync.Once
+	onClose   []func()
+
+	mutex    sync.Mutex
+	deadline time.Time
+}
+
+func newUDPFlow(local, client net.Addr, reply func(b []byte) error, replyFrom func(b []byte, from string) error) *udpFlow {
+	return &udpFlow{
+		local:     local,
+		client:    client,
+		reply:     reply,
+		replyFrom: replyFrom,
+		packets:   make(chan []byte, flowBacklog),
+		done:      make(chan struct{}),
+	}
+}
+
+// push queues a copy of the payload, which is dropped if the flow can't keep
+// up, as UDP does.
+func (f *udpFlow) push(payload []byte) {
+	packet := append([]byte(nil), payload...)
+	select {
+	case f.packets <- packet:
+	default:
+	}
+}
+
+// Read takes the deadline set before it's called.
+func (f *udpFlow) Read(b []byte) (int, error) {
+	f.mutex.Lock()
+	deadline := f.deadline
+	f.mutex.Unlock()
+
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		timer := time.NewTimer(time.Until(deadline))
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	select {
+	case packet := <-f.packets:
+		return copy(b, packet), nil
+	case <-f.done:
+		return 0, net.ErrClosed
+	case <-timeout:
+		return 0, os.ErrDeadlineExceeded
+	}
+}
+
+func (f *udpFlow) Write(b []byte) (int, error) {
+	if err := f.reply(b); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// WriteFrom writes the datagram to the client as if it were from the peer,
+// which the client hasn't sent to.
+func (f *udpFlow) WriteFrom(b []byte, from string) (int, error) {
+	if err := f.replyFrom(b, from); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (f *udpFlow) Close() error {
+	err := net.ErrClosed
+	f.closeOnce.Do(func() {
+		close(f.done)
+		for _, onClose := range f.onClose {
+			onClose()
+		}
+		err = nil
+	})
+	return err
+}
+
+func (f *udpFlow) LocalAddr() net.Addr {
+	return f.local
+}
+
+func (f *udpFlow) RemoteAddr() net.Addr {
+	return f.client
+}
+
+func (f *udpFlow) SetDeadline(t time.Time) error {
+	return f.SetReadDeadline(t)
+}
+
+func (f *udpFlow) SetReadDeadline(t time.Time) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.deadline = t
+	return nil
+}
+
+func (f *udpFlow) SetWriteDeadline(time.Time) error {
+	return nil
+}
+
+// udpFlows demultiplexes the datagrams of a UDP socket into the flows of
+// their clients and targets.
+type udpFlows struct {
+	mutex sync.Mutex
+	flows map[string]*udpFlow
+}
+
+func newUDPFlows() *udpFlows {
+	return &udpFlows{flows: make(map[string]*udpFlow)}
+}
+
+// get returns the flow of the client to the target, which is made by
+// newFlow if there isn't one, and is forgotten once closed.
+func (t *udpFlows) get(client net.Addr, target string, newFlow func() (*udpFlow, error)) (flow *udpFlow, created bool, err error) {
+	key := client.String() + " " + target
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if flow, ok := t.flows[key]; ok {
+		return flow, false, nil
+	}
+
+	if flow, err = newFlow(); err != nil {
+		return nil, false, err
+	}
+	flow.onClose = append(flow.onClose, func() {
+		t.mutex.Lock()
+		defer t.mutex.Unlock()
+		if t.flows[key] == flow {
+			delete(t.flows, key)
+		}
+	})
+	t.flows[key] = flow
+	return flow, true, nil
+}
+
+// closeFrom closes the flows of the clients of the IP.
+func (t *udpFlows) closeFrom(ip net.IP) {
+	t.mutex.Lock()
+	var flows []*udpFlow
+	for _, flow := range t.flows {
+		if client, ok := flow.client.(*net.UDPAddr); ok && client.IP.Equal(ip) {
+			flows = append(flows, flow)
+		}
+	}
+	t.mutex.Unlock()
+
+	for _, flow := range flows {
+		flow.Close()
+	}
+}
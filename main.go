@@ -6,12 +6,17 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"strings"
 	"syscall"
 	"time"
 
 	"github.com/fanpei91/spn/dialer"
+	"github.com/fanpei91/spn/dns"
 	"github.com/fanpei91/spn/proxy"
+	"github.com/fanpei91/spn/sniff"
 	"github.com/fanpei91/spn/system"
+	"github.com/fanpei91/spn/tun"
 	"github.com/sirupsen/logrus"
 )
 
@@ -22,14 +27,50 @@ type flags struct {
 	listenAddr              string
 	certFile                string
 	privateKeyFile          string
+	user                    string
 	secretKey               string
+	usersFile               string
 	reversedWebsite         string
+	dohURL                  string
+	dohFormat               string
+	dohMethod               string
 	staticDoHTTLInSeconds   uint
+	dotUpstream             string
+	dotServerName           string
+	tcpUpstream             string
+	dnsOverProxy            bool
 	rateLimitBytesPerSecond int
 	outboundIface           string
 	nic                     string
 	enableDNSFallback       bool
 	hijackDNS               bool
+	enableMux               bool
+	rulesFile               string
+	proxies                 stringsFlag
+	fakeIPFile              string
+	dnsRoutesFile           string
+	dnsStrategy             string
+	tunName                 string
+	tunAddr                 string
+	tunAddr6                string
+	fakeIPRange             string
+	mtu                     int
+	tunBacklog              int
+	enableTun               bool
+	socks5Addr              string
+	httpAddr                string
+	tproxyAddr              string
+	redirectAddr            string
+	gatewayDNSAddr          string
+	dnsMode                 string
+	dnsListenAddr           string
+	dotListenAddr           string
+	dohListenAddr           string
+	dnsCertFile             string
+	dnsKeyFile              string
+	sniffTimeoutInMillis    uint
+	sniffPorts              string
+	dnsServer               string
 	logLevel                string
 }
 
@@ -38,21 +79,61 @@ var (
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "user" {
+		userCommand(os.Args[2:])
+		return
+	}
 
 	flag.BoolVar(&f.serverMode, "server-mode", false, "server mode")
 	flag.StringVar(&f.serverAddr, "server-addr", "yourdomain.com:443", "the server address to connect to")
 	flag.StringVar(&f.listenAddr, "listen-addr", ":443", "server listens on given address")
 	flag.StringVar(&f.certFile, "cert-file", "", "cert file path")
 	flag.StringVar(&f.privateKeyFile, "private-key-file", "", "private key file path")
+	flag.StringVar(&f.user, "user", proxy.DefaultUser, "user to cross firewall as")
 	flag.StringVar(&f.secretKey, "secret-key", "secret key", "secrect key to cross firewall")
+	flag.StringVar(&f.usersFile, "users-file", "", "users file of the server, which overrides the secret key")
 	flag.StringVar(&f.reversedWebsite, "reversed-website", "http://mirror.siena.edu/ubuntu/", "reversed website to fool firewall")
+	flag.StringVar(&f.dohURL, "doh-url", dns.DefaultDNSOverHTTPSProvider, "DoH provider URL, which is queried through the server")
+	flag.StringVar(&f.dohFormat, "doh-format", dns.FormatWire, "DoH format: wire(RFC 8484) or json")
+	flag.StringVar(&f.dohMethod, "doh-method", http.MethodGet, "DoH method of the wire format: GET or POST")
 	flag.UintVar(&f.staticDoHTTLInSeconds, "static-doh-ttl", 86400, "static DoH ttl")
+	flag.StringVar(&f.dotUpstream, "dot-upstream", "", "DNS over TLS upstream to query after DoH fails, e.g. 1.1.1.1:853")
+	flag.StringVar(&f.dotServerName, "dot-server-name", "", "server name to verify the DNS over TLS upstream with, which is its host if empty")
+	flag.StringVar(&f.tcpUpstream, "tcp-upstream", "", "DNS over TCP upstream to query after DoH and DoT fail, e.g. 8.8.8.8:53")
+	flag.BoolVar(&f.dnsOverProxy, "dns-over-proxy", true, "query the DoT and TCP upstreams through the server")
 	flag.IntVar(&f.rateLimitBytesPerSecond, "rate-limit-bytes-per-second", 20*1024*1024, "rate limit bytes per second on fooling site")
 	flag.StringVar(&f.upstreamDNS, "upstream-dns", "114.114.114.114:53", "dns upstream")
-	flag.StringVar(&f.outboundIface, "outbound-iface", "en0", "outbound interface to bind to")
-	flag.StringVar(&f.nic, "nic", "Wi-Fi", "nic to set DNS on")
+	flag.StringVar(&f.outboundIface, "outbound-iface", defaultOutboundIface, "outbound interface to bind to")
+	flag.StringVar(&f.nic, "nic", defaultNIC, "nic to set DNS on, which is the one of the default route on Linux if empty")
 	flag.BoolVar(&f.enableDNSFallback, "enable-dns-fallback", true, "enable dns fallback when the safest dns way fails")
 	flag.BoolVar(&f.hijackDNS, "hijack-dns", true, "hijack DNS")
+	flag.BoolVar(&f.enableMux, "enable-mux", true, "multiplex the proxied connections over one HTTP/2 connection to the server")
+	flag.StringVar(&f.rulesFile, "rules-file", "", "rules file to route connections by, which keeps China and private addresses direct if empty")
+	flag.Var(&f.proxies, "proxy", "named proxy outbound of the rules besides PROXY, the server above, as name=https://[user:key@]host[:port], which may be repeated")
+	flag.StringVar(&f.fakeIPFile, "fake-ip-file", defaultFakeIPFile(), "file to keep the fake IPs across restarts, which isn't kept if empty")
+	flag.StringVar(&f.dnsRoutesFile, "dns-routes-file", "", "file of dnsmasq server lines to route the queries by domain, e.g. server=/cn/114.114.114.114")
+	flag.StringVar(&f.dnsStrategy, "dns-strategy", string(dns.StrategySequential), "how to ask the DNS upstreams: sequential, parallel or adaptive")
+	flag.StringVar(&f.tunName, "tun-name", "utun", "tun device name")
+	flag.StringVar(&f.tunAddr, "tun-addr", "198.18.0.1/16", "IPv4 address of the tun device")
+	flag.StringVar(&f.tunAddr6, "tun-addr6", "", "IPv6 address of the tun device, which routes IPv6 to the tun as well, e.g. fdfe:dcba:9876::1/126")
+	flag.StringVar(&f.fakeIPRange, "fake-ip-range", "198.18.0.0/16", "IPv4 range of the fake IPs")
+	flag.IntVar(&f.mtu, "mtu", 1500, "MTU of the tun device")
+	flag.IntVar(&f.tunBacklog, "tun-backlog", tun.DefaultBacklog, "number of the tun connections of each network waiting to be handled, beyond which the new ones are dropped")
+	flag.StringVar(&f.dnsServer, "dns-server", "1.1.1.1", "DNS server to set on the nic, which is hijacked")
+	flag.BoolVar(&f.enableTun, "enable-tun", true, "route the system to the tun device, which needs root")
+	flag.StringVar(&f.socks5Addr, "socks5-addr", "", "SOCKS5 inbound address, e.g. 127.0.0.1:1080")
+	flag.StringVar(&f.httpAddr, "http-addr", "", "HTTP proxy inbound address, e.g. 127.0.0.1:8080")
+	flag.StringVar(&f.tproxyAddr, "tproxy-addr", "", "Linux only, TPROXY inbound address of TCP and UDP for the LAN devices, e.g. :7893")
+	flag.StringVar(&f.redirectAddr, "redirect-addr", "", "Linux only, REDIRECT inbound address of TCP for the LAN devices, e.g. :7892")
+	flag.StringVar(&f.gatewayDNSAddr, "gateway-dns-addr", "", "address of the DNS answering the LAN devices as the hijacked DNS does, e.g. :53")
+	flag.StringVar(&f.dnsMode, "dns-mode", string(dns.ModeFakeIP), "answers of the hijacked DNS and the DNS listeners: fake-ip, or real-ip for the software which checks or keeps the addresses")
+	flag.StringVar(&f.dnsListenAddr, "dns-listen-addr", "", "address of the DNS over UDP and TCP for the other machines, e.g. :53")
+	flag.StringVar(&f.dotListenAddr, "dot-listen-addr", "", "address of the DNS over TLS for the other machines, e.g. :853")
+	flag.StringVar(&f.dohListenAddr, "doh-listen-addr", "", "address of the DNS over HTTPS for the other machines at /dns-query, which is HTTP without -dns-cert-file, e.g. :443")
+	flag.StringVar(&f.dnsCertFile, "dns-cert-file", "", "cert file of the DoT and DoH listeners")
+	flag.StringVar(&f.dnsKeyFile, "dns-key-file", "", "private key file of the DoT and DoH listeners")
+	flag.UintVar(&f.sniffTimeoutInMillis, "sniff-timeout", 300, "milliseconds to wait for the first bytes of the connections to real IPs to sniff their domains, 0 to disable")
+	flag.StringVar(&f.sniffPorts, "sniff-ports", sniff.DefaultPorts, "comma separated network/port pairs of the connections to real IPs to sniff, whose sniffed domains replace the IPs as their destinations")
 	flag.StringVar(&f.logLevel, "log-level", "INFO", "log level: TRACE, DEBUG, INFO, WARN, ERROR, FATAL, PANIC")
 	flag.Parse()
 
@@ -73,6 +154,7 @@ func main() {
 		logrus.Infof("cert file: %s", f.certFile)
 		logrus.Infof("private key file: %s", f.privateKeyFile)
 		logrus.Infof("secret key: %s", f.secretKey)
+		logrus.Infof("users file: %s", f.usersFile)
 		logrus.Infof("reversed website: %s", f.reversedWebsite)
 		logrus.Infof("rate limit bytes per second: %d", f.rateLimitBytesPerSecond)
 		startServer()
@@ -81,25 +163,87 @@ func main() {
 
 	logrus.Info("mode: client")
 	logrus.Infof("server address: %s", f.serverAddr)
+	logrus.Infof("user: %s", f.user)
 	logrus.Infof("secret key: %s", f.secretKey)
+	logrus.Infof("DoH: %s %s %s", f.dohMethod, f.dohURL, f.dohFormat)
 	logrus.Infof("static DoH TTL: %d", f.staticDoHTTLInSeconds)
+	logrus.Infof("DoT upstream: %s", f.dotUpstream)
+	logrus.Infof("TCP upstream: %s", f.tcpUpstream)
+	logrus.Infof("DNS over proxy: %v", f.dnsOverProxy)
 	logrus.Infof("upstream DNS: %s", f.upstreamDNS)
 	logrus.Infof("outbound interface: %s", f.outboundIface)
 	logrus.Infof("nic: %s", f.nic)
 	logrus.Infof("DNS fallback enabled: %v", f.enableDNSFallback)
 	logrus.Infof("hijack DNS: %v", f.hijackDNS)
+	logrus.Infof("mux enabled: %v", f.enableMux)
+	logrus.Infof("rules file: %s", f.rulesFile)
+	logrus.Infof("proxies: %v", f.proxies)
+	logrus.Infof("fake IP file: %s", f.fakeIPFile)
+	logrus.Infof("DNS routes file: %s", f.dnsRoutesFile)
+	logrus.Infof("DNS strategy: %s", f.dnsStrategy)
+	logrus.Infof("tun: %s %s %s mtu %d backlog %d", f.tunName, f.tunAddr, f.tunAddr6, f.mtu, f.tunBacklog)
+	logrus.Infof("fake IP range: %s", f.fakeIPRange)
+	logrus.Infof("DNS server: %s", f.dnsServer)
+	logrus.Infof("tun enabled: %v", f.enableTun)
+	logrus.Infof("SOCKS5 inbound: %s", f.socks5Addr)
+	logrus.Infof("HTTP inbound: %s", f.httpAddr)
+	logrus.Infof("TPROXY inbound: %s", f.tproxyAddr)
+	logrus.Infof("REDIRECT inbound: %s", f.redirectAddr)
+	logrus.Infof("gateway DNS: %s", f.gatewayDNSAddr)
+	logrus.Infof("DNS mode: %s", f.dnsMode)
+	logrus.Infof("DNS listeners: %s %s %s", f.dnsListenAddr, f.dotListenAddr, f.dohListenAddr)
+	logrus.Infof("sniff timeout: %dms", f.sniffTimeoutInMillis)
+	logrus.Infof("sniff ports: %s", f.sniffPorts)
 
 	dialer.Bind(f.outboundIface)
 
-	sys, _ := system.New(
-		f.nic,
-		f.upstreamDNS,
-		f.secretKey,
-		f.serverAddr,
-		time.Duration(f.staticDoHTTLInSeconds)*time.Second,
-		f.enableDNSFallback,
-		f.hijackDNS,
-	)
+	sys, err := system.New(system.Config{
+		NIC:               f.nic,
+		UpstreamDNS:       f.upstreamDNS,
+		ServerAddr:        f.serverAddr,
+		User:              f.user,
+		SecretKey:         f.secretKey,
+		DoHURL:            f.dohURL,
+		DoHFormat:         f.dohFormat,
+		DoHMethod:         f.dohMethod,
+		StaticDoHTTL:      time.Duration(f.staticDoHTTLInSeconds) * time.Second,
+		DoTUpstream:       f.dotUpstream,
+		DoTServerName:     f.dotServerName,
+		TCPUpstream:       f.tcpUpstream,
+		DNSOverProxy:      f.dnsOverProxy,
+		EnableDNSFallback: f.enableDNSFallback,
+		HijackDNS:         f.hijackDNS,
+		EnableMux:         f.enableMux,
+		RulesFile:         f.rulesFile,
+		Proxies:           f.proxies,
+		FakeIPFile:        f.fakeIPFile,
+		DNSRoutesFile:     f.dnsRoutesFile,
+		DNSStrategy:       f.dnsStrategy,
+		TunName:           f.tunName,
+		TunAddr:           f.tunAddr,
+		TunAddr6:          f.tunAddr6,
+		FakeIPRange:       f.fakeIPRange,
+		MTU:               f.mtu,
+		TunBacklog:        f.tunBacklog,
+		DNSServer:         f.dnsServer,
+		EnableTun:         f.enableTun,
+		SOCKS5Addr:        f.socks5Addr,
+		HTTPAddr:          f.httpAddr,
+		TProxyAddr:        f.tproxyAddr,
+		RedirectAddr:      f.redirectAddr,
+		GatewayDNSAddr:    f.gatewayDNSAddr,
+		DNSMode:           f.dnsMode,
+		DNSListenAddr:     f.dnsListenAddr,
+		DoTListenAddr:     f.dotListenAddr,
+		DoHListenAddr:     f.dohListenAddr,
+		DNSCertFile:       f.dnsCertFile,
+		DNSKeyFile:        f.dnsKeyFile,
+		SniffTimeout:      time.Duration(f.sniffTimeoutInMillis) * time.Millisecond,
+		SniffPorts:        f.sniffPorts,
+	})
+	if err != nil {
+		logrus.Fatalf("%s", err.Error())
+	}
 
 	if err := sys.Setup(); err != nil {
 		sys.Destroy()
@@ -119,8 +263,53 @@ func startServer() {
 		logrus.Fatalf("server failed to listen on %s: %s", f.listenAddr, err)
 	}
 
-	server := proxy.NewFoolingServer(f.secretKey, f.reversedWebsite, f.rateLimitBytesPerSecond)
-	if err := http.ServeTLS(listener, server, f.certFile, f.privateKeyFile); err != nil {
+	users := proxy.NewStaticUserStore(f.secretKey)
+	if f.usersFile != "" {
+		if users, err = proxy.OpenUserStore(f.usersFile); err != nil {
+			logrus.Fatalf("server failed to open users file %s: %s", f.usersFile, err)
+		}
+	}
+
+	server := proxy.NewFoolingServer(users, f.reversedWebsite, f.rateLimitBytesPerSecond)
+	errs := make(chan error, 1)
+	go func() {
+		errs <- http.ServeTLS(listener, server, f.certFile, f.privateKeyFile)
+	}()
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+
+	// The usage since it was saved last is saved before exiting.
+	select {
+	case err = <-errs:
+	case <-sigs:
+	}
+	if err := users.Close(); err != nil {
+		logrus.Errorf("failed to save usage of users: %v", err)
+	}
+	if err != nil {
 		logrus.Fatalf("server failed to start https server: %s", err)
 	}
 }
+
+// defaultFakeIPFile is in the cache directory of the user, which others can't
+// write to, unlike the temporary one.
+func defaultFakeIPFile() string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "sandwich", "fakeip.json")
+}
+
+// stringsFlag collects the values of a flag which may be repeated.
+type stringsFlag []string
+
+func (f *stringsFlag) String() string {
+	return strings.Join(*f, ",")
+}
+
+func (f *stringsFlag) Set(s string) error {
+	*f = append(*f, s)
+	return nil
+}
@@ -0,0 +1,116 @@
+package proxy
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	TokenSkew  = 2 * time.Minute
+	nonceBytes = 16
+)
+
+// NewToken signs the target with a timestamp and a random nonce, so that a
+// captured token can be neither replayed nor reused for another target:
+//
+//	<user>.<unix timestamp>.<hex nonce>.<hex HMAC-SHA256(secretKey, user.timestamp.nonce.target)>
+func NewToken(user, secretKey, target string) string {
+	nonce := make([]byte, nonceBytes)
+	rand.Read(nonce)
+
+	payload := user + "." + strconv.FormatInt(time.Now().Unix(), 10) + "." + hex.EncodeToString(nonce)
+	return payload + "." + hex.EncodeToString(sign(secretKey, payload, target))
+}
+
+func AuthHeader(user, secretKey, target string) http.Header {
+	return http.Header{
+		HeaderToken: []string{NewToken(user, secretKey, target)},
+	}
+}
+
+func sign(secretKey, payload, target string) []byte {
+	mac := hmac.New(sha256.New, []byte(secretKey))
+	mac.Write([]byte(payload))
+	mac.Write([]byte("."))
+	mac.Write([]byte(target))
+	return mac.Sum(nil)
+}
+
+type authenticator struct {
+	users   *UserStore
+	mutex   sync.Mutex
+	nonces  map[string]time.Time
+	pruneAt time.Time
+}
+
+func newAuthenticator(users *UserStore) *authenticator {
+	return &authenticator{
+		users:  users,
+		nonces: make(map[string]time.Time),
+	}
+}
+
+// verify returns the user the token is issued by if it is valid.
+func (a *authenticator) verify(token, target string) (string, bool) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 4 {
+		return "", false
+	}
+	user := parts[0]
+
+	secretKey, ok := a.users.key(user)
+	if !ok {
+		return "", false
+	}
+
+	timestamp, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return "", false
+	}
+
+	now := time.Now()
+	issuedAt := time.Unix(timestamp, 0)
+	if issuedAt.Before(now.Add(-TokenSkew)) || issuedAt.After(now.Add(TokenSkew)) {
+		return "", false
+	}
+
+	mac, err := hex.DecodeString(parts[3])
+	if err != nil {
+		return "", false
+	}
+	if !hmac.Equal(mac, sign(secretKey, strings.Join(parts[:3], "."), target)) {
+		return "", false
+	}
+
+	return user, a.remember(parts[2], issuedAt.Add(TokenSkew), now)
+}
+
+// remember reports whether the nonce is fresh. A nonce only has to be kept
+// until its token falls out of the skew window, after which the timestamp
+// check rejects it anyway.
+func (a *authenticator) remember(nonce string, expiredAt, now time.Time) bool {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	if now.After(a.pruneAt) {
+		for n, e := range a.nonces {
+			if e.Before(now) {
+				delete(a.nonces, n)
+			}
+		}
+		a.pruneAt = now.Add(TokenSkew)
+	}
+
+	if _, ok := a.nonces[nonce]; ok {
+		return false
+	}
+	a.nonces[nonce] = expiredAt
+	return true
+}
@@ -0,0 +1,33 @@
+package proxy
+
+import (
+	"encoding/hex"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestAuthenticator(t *testing.T) {
+	a := newAuthenticator(NewStaticUserStore("key"))
+	verify := func(token, target string) bool {
+		_, ok := a.verify(token, target)
+		return ok
+	}
+
+	token := NewToken(DefaultUser, "key", "example.com:443")
+	require.False(t, verify(token, "example.com:80"))
+	require.True(t, verify(token, "example.com:443"))
+	require.False(t, verify(token, "example.com:443"))
+
+	require.False(t, verify(NewToken(DefaultUser, "other key", "example.com:443"), "example.com:443"))
+	require.False(t, verify(NewToken("nobody", "key", "example.com:443"), "example.com:443"))
+	require.False(t, verify("", "example.com:443"))
+
+	nonce := strings.Split(NewToken(DefaultUser, "key", "example.com:443"), ".")[2]
+	payload := DefaultUser + "." + strconv.FormatInt(time.Now().Add(-2*TokenSkew).Unix(), 10) + "." + nonce
+	stale := payload + "." + hex.EncodeToString(sign("key", payload, "example.com:443"))
+	require.False(t, verify(stale, "example.com:443"))
+}
@@ -3,10 +3,20 @@ package proxy
 import (
 	"context"
 	"net"
+	"time"
 
 	"github.com/fanpei91/spn/dialer"
 )
 
+// fallbackDelay is how long the addresses of one family are tried before the
+// ones of the other family race them, as of Happy Eyeballs (RFC 8305).
+const fallbackDelay = 300 * time.Millisecond
+
+// AddrsClient dials the first reachable one of the addresses of a host.
+type AddrsClient interface {
+	DialAddrs(ctx context.Context, network string, ips []net.IP, port string) (net.Conn, error)
+}
+
 type directClient struct{}
 
 var Direct Client = directClient{}
@@ -20,6 +30,92 @@ func (d directClient) Dial(ctx context.Context, network string, ipAddr string) (
 	return dial.DialContext(ctx, network, ipAddr)
 }
 
+// DialAddrs tries the addresses of the family of the first one in turn, and
+// those of the other family as well after fallbackDelay or a failure.
+func (d directClient) DialAddrs(ctx context.Context, network string, ips []net.IP, port string) (net.Conn, error) {
+	var primaries, fallbacks []string
+	for _, ip := range ips {
+		addr := net.JoinHostPort(ip.String(), port)
+		if (ip.To4() != nil) == (ips[0].To4() != nil) {
+			primaries = append(primaries, addr)
+		} else {
+			fallbacks = append(fallbacks, addr)
+		}
+	}
+	if len(fallbacks) == 0 {
+		return d.dialSerial(ctx, network, primaries)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type dialResult struct {
+		conn net.Conn
+		err  error
+	}
+
+	results := make(chan dialResult, 2)
+	race := func(addrs []string) {
+		conn, err := d.dialSerial(ctx, network, addrs)
+		results <- dialResult{conn: conn, err: err}
+	}
+
+	go race(primaries)
+	pending := 1
+
+	fallback := time.NewTimer(fallbackDelay)
+	defer fallback.Stop()
+
+	var firstErr error
+	for {
+		select {
+		case <-fallback.C:
+			go race(fallbacks)
+			pending++
+		case result := <-results:
+			pending--
+			if result.err == nil {
+				go func(pending int) {
+					for ; pending > 0; pending-- {
+						if loser := <-results; loser.conn != nil {
+							loser.conn.Close()
+						}
+					}
+				}(pending)
+				return result.conn, nil
+			}
+
+			if firstErr == nil {
+				firstErr = result.err
+			}
+			if fallback.Stop() {
+				go race(fallbacks)
+				pending++
+			}
+			if pending == 0 {
+				return nil, firstErr
+			}
+		}
+	}
+}
+
+func (d directClient) dialSerial(ctx context.Context, network string, addrs []string) (net.Conn, error) {
+	var firstErr error
+	for _, addr := range addrs {
+		conn, err := d.Dial(ctx, network, addr)
+		if err == nil {
+			return conn, nil
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, firstErr
+}
+
 func (d directClient) String() string {
 	return "DIRECT"
 }
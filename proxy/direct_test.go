@@ -0,0 +1,31 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDialAddrs(t *testing.T) {
+	l, err := net.Listen("tcp4", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+	port := strconv.Itoa(l.Addr().(*net.TCPAddr).Port)
+
+	client := Direct.(AddrsClient)
+	for _, ips := range [][]net.IP{
+		{net.ParseIP("127.0.0.2"), net.ParseIP("127.0.0.1")},
+		{net.ParseIP("::1"), net.ParseIP("127.0.0.1")},
+	} {
+		conn, err := client.DialAddrs(context.Background(), "tcp", ips, port)
+		require.NoError(t, err)
+		require.Equal(t, l.Addr().String(), conn.RemoteAddr().String())
+		conn.Close()
+	}
+
+	_, err = client.DialAddrs(context.Background(), "tcp", []net.IP{net.ParseIP("127.0.0.2")}, port)
+	require.Error(t, err)
+}
@@ -18,25 +18,35 @@ type Client interface {
 	String() string
 }
 
-var HTTPS = func(server, dns string, extraHeader http.Header) Client {
-	return NewHTTPSClient(server, dns, extraHeader)
+// HostClient dials a target by its host name, which is resolved on the
+// other side.
+type HostClient interface {
+	DialHost(ctx context.Context, network, addr string) (net.Conn, error)
 }
 
-type httpsClient struct {
-	dns         string
-	server      string
-	extraHeader http.Header
+var HTTPS = func(server, dns, user, secretKey string, mux bool) Client {
+	return NewHTTPSClient(server, dns, user, secretKey, mux)
 }
 
-func NewHTTPSClient(server, dns string, extraHeader http.Header) *httpsClient {
-	return &httpsClient{
-		server:      server,
-		dns:         dns,
-		extraHeader: extraHeader,
+type HTTPSClient struct {
+	dns       string
+	server    string
+	user      string
+	secretKey string
+	mux       bool
+}
+
+func NewHTTPSClient(server, dns, user, secretKey string, mux bool) *HTTPSClient {
+	return &HTTPSClient{
+		server:    server,
+		dns:       dns,
+		user:      user,
+		secretKey: secretKey,
+		mux:       mux,
 	}
 }
 
-func (t *httpsClient) Dial(ctx context.Context, network string, ipAddr string) (net.Conn, error) {
+func (t *HTTPSClient) Dial(ctx context.Context, network string, ipAddr string) (net.Conn, error) {
 	conn, err := t.DialHost(ctx, network, ipAddr)
 	if err != nil {
 		return nil, err
@@ -55,7 +65,17 @@ func (t *httpsClient) Dial(ctx context.Context, network string, ipAddr string) (
 	}, nil
 }
 
-func (t *httpsClient) DialHost(ctx context.Context, network, addr string) (net.Conn, error) {
+func (t *HTTPSClient) DialHost(ctx context.Context, network, addr string) (net.Conn, error) {
+	if t.mux {
+		m := getMuxTransport(t.server, t.dns)
+		if m.supported() {
+			conn, err := m.dial(ctx, addr, t.header(network, addr))
+			if err != errMuxNotSupported {
+				return conn, err
+			}
+		}
+	}
+
 	d, err := dialer.NewWithResolver(t.dns)
 	if err != nil {
 		return nil, err
@@ -75,19 +95,32 @@ func (t *httpsClient) DialHost(ctx context.Context, network, addr string) (net.C
 	return conn, nil
 }
 
-func (t *httpsClient) String() string {
+func (t *HTTPSClient) ListenPacket(ctx context.Context) (PacketConn, error) {
+	conn, err := t.DialHost(ctx, NetworkUDPRelay, relayTarget)
+	if err != nil {
+		return nil, err
+	}
+	return newRelayConn(conn), nil
+}
+
+func (t *HTTPSClient) String() string {
 	return "HTTPS"
 }
 
-func (t *httpsClient) connect(conn net.Conn, network, target string) error {
+func (t *HTTPSClient) header(network, target string) http.Header {
+	header := AuthHeader(t.user, t.secretKey, target)
+	header.Set(HeaderNetwork, network)
+	return header
+}
+
+func (t *HTTPSClient) connect(conn net.Conn, network, target string) error {
 	fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\n", target)
 	var header = make(http.Header, 0)
 	header.Add("User-Agent", "Mozilla/5.0 (Macintosh; Intel Mac OS X 10_14_6) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/87.0.4280.88 Safari/537.36")
 	header.Add("Proxy-Connection", "keep-alive")
 	header.Add("Connection", "keep-alive")
 	header.Add("Host", t.server)
-	header.Add(HeaderNetwork, network)
-	for k, values := range t.extraHeader {
+	for k, values := range t.header(network, target) {
 		for _, v := range values {
 			header.Add(k, v)
 		}
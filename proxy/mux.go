@@ -0,0 +1,439 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Dreamacro/clash/common/pool"
+	"github.com/fanpei91/spn/dialer"
+)
+
+var errMuxNotSupported = errors.New("server does not support multiplexing")
+
+const (
+	muxMinRetryInterval = time.Minute
+	muxMaxRetryInterval = time.Hour
+)
+
+var muxTransports = struct {
+	sync.Mutex
+	m map[string]*muxTransport
+}{
+	m: make(map[string]*muxTransport),
+}
+
+// muxTransport carries many CONNECT streams over one long-lived HTTP/2
+// connection to the server. It is negotiated by ALPN, and a server that does
+// not speak h2 makes the client fall back to one connection per stream until
+// it is asked again, later and later after each failure.
+type muxTransport struct {
+	server    string
+	transport *http.Transport
+	mutex     sync.Mutex
+	failures  int
+	retryAt   time.Time
+	addrs     atomic.Value
+}
+
+type connAddrs struct {
+	local  net.Addr
+	remote net.Addr
+}
+
+func getMuxTransport(server, dns string) *muxTransport {
+	muxTransports.Lock()
+	defer muxTransports.Unlock()
+
+	key := server + "|" + dns
+	if m, ok := muxTransports.m[key]; ok {
+		return m
+	}
+
+	m := &muxTransport{server: server}
+	m.transport = &http.Transport{
+		ForceAttemptHTTP2: true,
+		IdleConnTimeout:   5 * time.Minute,
+		DialTLSContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return m.dialTLS(ctx, dns)
+		},
+	}
+	muxTransports.m[key] = m
+	return m
+}
+
+func (m *muxTransport) supported() bool {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return !time.Now().Before(m.retryAt)
+}
+
+func (m *muxTransport) setSupported(supported bool) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if supported {
+		m.failures = 0
+		m.retryAt = time.Time{}
+		return
+	}
+
+	interval := muxMaxRetryInterval
+	if m.failures < 6 {
+		interval = muxMinRetryInterval << m.failures
+	}
+	m.failures++
+	m.retryAt = time.Now().Add(interval)
+}
+
+func (m *muxTransport) dialTLS(ctx context.Context, dns string) (net.Conn, error) {
+	d, err := dialer.NewWithResolver(dns)
+	if err != nil {
+		return nil, err
+	}
+
+	host, _, _ := net.SplitHostPort(m.server)
+	tlsDialer := new(tls.Dialer)
+	tlsDialer.NetDialer = d
+	tlsDialer.Config = &tls.Config{
+		ServerName: host,
+		NextProtos: []string{"h2", "http/1.1"},
+	}
+	conn, err := tlsDialer.DialContext(ctx, "tcp", m.server)
+	if err != nil {
+		return nil, err
+	}
+
+	if conn.(*tls.Conn).ConnectionState().NegotiatedProtocol != "h2" {
+		m.setSupported(false)
+		conn.Close()
+		return nil, errMuxNotSupported
+	}
+	m.setSupported(true)
+
+	m.addrs.Store(connAddrs{local: conn.LocalAddr(), remote: conn.RemoteAddr()})
+	return conn, nil
+}
+
+func (m *muxTransport) dial(ctx context.Context, target string, header http.Header) (net.Conn, error) {
+	// The stream outlives the dialing context, which only bounds the setup.
+	streamCtx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			cancel()
+		case <-done:
+		}
+	}()
+
+	pr, pw := io.Pipe()
+	req := &http.Request{
+		Method:     http.MethodConnect,
+		URL:        &url.URL{Scheme: "https", Host: m.server},
+		Host:       target,
+		Header:     header,
+		Body:       pr,
+		Proto:      "HTTP/2.0",
+		ProtoMajor: 2,
+	}
+
+	res, err := m.transport.RoundTrip(req.WithContext(streamCtx))
+	if err != nil {
+		cancel()
+		pw.Close()
+		if !m.supported() {
+			return nil, errMuxNotSupported
+		}
+		return nil, err
+	}
+
+	if res.StatusCode != http.StatusOK {
+		cancel()
+		pw.Close()
+		res.Body.Close()
+		return nil, errors.New("connection is not established")
+	}
+
+	addrs, _ := m.addrs.Load().(connAddrs)
+	return newStreamConn(res.Body, pw, cancel, addrs), nil
+}
+
+// streamConn is a stream of the HTTP/2 connection, whose body can't be
+// woken up from a blocked read or write. They are done in the background
+// instead, so that a deadline fails the pending one and can be set again, as
+// of net.Conn.
+type streamConn struct {
+	body   io.ReadCloser
+	pw     *io.PipeWriter
+	cancel context.CancelFunc
+	addrs  connAddrs
+	once   sync.Once
+	done   chan struct{}
+
+	rmutex        sync.Mutex
+	reads         chan streamResult
+	readDone      chan struct{}
+	pending       []byte
+	readErr       error
+	readDeadline  *deadline
+	wmutex        sync.Mutex
+	writes        chan []byte
+	written       chan streamResult
+	writing       bool
+	writeErr      error
+	writeDeadline *deadline
+}
+
+type streamResult struct {
+	b   []byte
+	n   int
+	err error
+}
+
+func newStreamConn(body io.ReadCloser, pw *io.PipeWriter, cancel context.CancelFunc, addrs connAddrs) *streamConn {
+	c := &streamConn{
+		body:          body,
+		pw:            pw,
+		cancel:        cancel,
+		addrs:         addrs,
+		done:          make(chan struct{}),
+		reads:         make(chan streamResult),
+		readDone:      make(chan struct{}),
+		readDeadline:  newDeadline(),
+		writes:        make(chan []byte),
+		written:       make(chan streamResult, 1),
+		writeDeadline: newDeadline(),
+	}
+	go c.readLoop()
+	go c.writeLoop()
+	return c
+}
+
+// readLoop reads the body into the same buffer, which is read again once
+// Read has taken all of it.
+func (c *streamConn) readLoop() {
+	buf := pool.Get(pool.RelayBufferSize)
+	defer pool.Put(buf)
+
+	for {
+		n, err := c.body.Read(buf)
+		select {
+		case c.reads <- streamResult{b: buf[:n], err: err}:
+		case <-c.done:
+			return
+		}
+		if err != nil {
+			return
+		}
+
+		select {
+		case <-c.readDone:
+		case <-c.done:
+			return
+		}
+	}
+}
+
+func (c *streamConn) Read(b []byte) (int, error) {
+	c.rmutex.Lock()
+	defer c.rmutex.Unlock()
+
+	if len(c.pending) == 0 && c.readErr == nil {
+		select {
+		case r := <-c.reads:
+			c.pending, c.readErr = r.b, r.err
+		case <-c.readDeadline.wait():
+			return 0, os.ErrDeadlineExceeded
+		case <-c.done:
+			return 0, net.ErrClosed
+		}
+	}
+
+	if len(c.pending) == 0 {
+		return 0, c.readErr
+	}
+	n := copy(b, c.pending)
+	c.pending = c.pending[n:]
+	if len(c.pending) == 0 && c.readErr == nil {
+		select {
+		case c.readDone <- struct{}{}:
+		case <-c.done:
+		}
+	}
+	return n, nil
+}
+
+// writeLoop writes the copies of what Write is given, which are written even
+// after their deadlines are reached, in order.
+func (c *streamConn) writeLoop() {
+	for {
+		select {
+		case b := <-c.writes:
+			n, err := c.pw.Write(b)
+			pool.Put(b)
+			c.written <- streamResult{n: n, err: err}
+			if err != nil {
+				return
+			}
+		case <-c.done:
+			return
+		}
+	}
+}
+
+func (c *streamConn) Write(b []byte) (int, error) {
+	c.wmutex.Lock()
+	defer c.wmutex.Unlock()
+
+	// The write whose deadline was reached is waited for first.
+	if c.writing {
+		if _, err := c.waitWritten(); err != nil {
+			return 0, err
+		}
+	}
+	if c.writeErr != nil {
+		return 0, c.writeErr
+	}
+
+	n := 0
+	for len(b) > 0 {
+		buf := pool.Get(pool.RelayBufferSize)
+		m := copy(buf, b)
+		b = b[m:]
+
+		select {
+		case c.writes <- buf[:m]:
+		case <-c.writeDeadline.wait():
+			pool.Put(buf)
+			return n, os.ErrDeadlineExceeded
+		case <-c.done:
+			pool.Put(buf)
+			return n, net.ErrClosed
+		}
+
+		c.writing = true
+		written, err := c.waitWritten()
+		n += written
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+func (c *streamConn) waitWritten() (int, error) {
+	select {
+	case r := <-c.written:
+		c.writing = false
+		c.writeErr = r.err
+		return r.n, r.err
+	case <-c.writeDeadline.wait():
+		return 0, os.ErrDeadlineExceeded
+	case <-c.done:
+		return 0, net.ErrClosed
+	}
+}
+
+func (c *streamConn) Close() error {
+	c.once.Do(func() {
+		close(c.done)
+		c.pw.Close()
+		c.body.Close()
+		c.cancel()
+	})
+	return nil
+}
+
+func (c *streamConn) LocalAddr() net.Addr {
+	return c.addrs.local
+}
+
+func (c *streamConn) RemoteAddr() net.Addr {
+	return c.addrs.remote
+}
+
+func (c *streamConn) SetDeadline(t time.Time) error {
+	c.SetReadDeadline(t)
+	return c.SetWriteDeadline(t)
+}
+
+func (c *streamConn) SetReadDeadline(t time.Time) error {
+	c.readDeadline.set(t)
+	return nil
+}
+
+func (c *streamConn) SetWriteDeadline(t time.Time) error {
+	c.writeDeadline.set(t)
+	return nil
+}
+
+// deadline is closed once the time set is reached, and is made again when
+// another one is set, as the deadlines of net.Pipe are.
+type deadline struct {
+	mutex  sync.Mutex
+	timer  *time.Timer
+	cancel chan struct{}
+}
+
+func newDeadline() *deadline {
+	return &deadline{cancel: make(chan struct{})}
+}
+
+func (d *deadline) set(t time.Time) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if d.timer != nil && !d.timer.Stop() {
+		// The timer has fired, wait for it to close the channel.
+		<-d.cancel
+	}
+	d.timer = nil
+
+	closed := isClosed(d.cancel)
+	if t.IsZero() {
+		if closed {
+			d.cancel = make(chan struct{})
+		}
+		return
+	}
+
+	if dur := time.Until(t); dur > 0 {
+		if closed {
+			d.cancel = make(chan struct{})
+		}
+		cancel := d.cancel
+		d.timer = time.AfterFunc(dur, func() {
+			close(cancel)
+		})
+		return
+	}
+
+	if !closed {
+		close(d.cancel)
+	}
+}
+
+func (d *deadline) wait() chan struct{} {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return d.cancel
+}
+
+func isClosed(c chan struct{}) bool {
+	select {
+	case <-c:
+		return true
+	default:
+		return false
+	}
+}
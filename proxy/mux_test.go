@@ -0,0 +1,67 @@
+package proxy
+
+import (
+	"io"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMuxRetry(t *testing.T) {
+	m := &muxTransport{}
+	require.True(t, m.supported())
+
+	m.setSupported(false)
+	require.False(t, m.supported())
+	require.WithinDuration(t, time.Now().Add(muxMinRetryInterval), m.retryAt, time.Second)
+	m.setSupported(false)
+	require.WithinDuration(t, time.Now().Add(2*muxMinRetryInterval), m.retryAt, time.Second)
+
+	m.retryAt = time.Now()
+	require.True(t, m.supported())
+	m.setSupported(true)
+	require.Equal(t, 0, m.failures)
+}
+
+func TestStreamConnDeadline(t *testing.T) {
+	body, server := io.Pipe()
+	client, pw := io.Pipe()
+	c := newStreamConn(body, pw, func() {}, connAddrs{})
+	defer c.Close()
+
+	c.SetReadDeadline(time.Now().Add(time.Hour))
+	c.SetReadDeadline(time.Time{})
+	c.SetReadDeadline(time.Now().Add(20 * time.Millisecond))
+
+	start := time.Now()
+	_, err := c.Read(make([]byte, 1))
+	require.Equal(t, os.ErrDeadlineExceeded, err)
+	require.True(t, time.Since(start) >= 20*time.Millisecond)
+
+	// The stream is still usable once the deadline is cleared.
+	c.SetReadDeadline(time.Time{})
+	go server.Write([]byte("pong"))
+	buf := make([]byte, 4)
+	_, err = io.ReadFull(c, buf)
+	require.NoError(t, err)
+	require.Equal(t, "pong", string(buf))
+
+	c.SetWriteDeadline(time.Now().Add(20 * time.Millisecond))
+	_, err = c.Write([]byte("ping"))
+	require.Equal(t, os.ErrDeadlineExceeded, err)
+
+	// The write past its deadline is done before the next one.
+	c.SetWriteDeadline(time.Time{})
+	errc := make(chan error, 1)
+	go func() {
+		_, err := c.Write([]byte("ping"))
+		errc <- err
+	}()
+	buf = make([]byte, 8)
+	_, err = io.ReadFull(client, buf)
+	require.NoError(t, err)
+	require.Equal(t, "pingping", string(buf))
+	require.NoError(t, <-errc)
+}
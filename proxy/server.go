@@ -1,6 +1,7 @@
 package proxy
 
 import (
+	"errors"
 	"fmt"
 	"io"
 	"net"
@@ -16,7 +17,7 @@ import (
 )
 
 const (
-	HeaderSecret  = "Misha-Secret"
+	HeaderToken   = "Misha-Token"
 	HeaderNetwork = "Network"
 )
 
@@ -25,28 +26,30 @@ const (
 )
 
 type FoolingServer struct {
-	secretKey               string
+	auth                    *authenticator
+	users                   *UserStore
 	reversedWebsite         string
 	rateLimitBytesPerSecond int
 }
 
-func NewFoolingServer(secretKey, reversedWebsite string, rateLimitBytesPerSecond int) *FoolingServer {
+func NewFoolingServer(users *UserStore, reversedWebsite string, rateLimitBytesPerSecond int) *FoolingServer {
 	return &FoolingServer{
-		secretKey:               secretKey,
+		auth:                    newAuthenticator(users),
+		users:                   users,
 		reversedWebsite:         reversedWebsite,
 		rateLimitBytesPerSecond: rateLimitBytesPerSecond,
 	}
 }
 
 func (s *FoolingServer) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
-	if req.Header.Get(HeaderSecret) == s.secretKey {
-		s.crossWall(rw, req)
+	if user, ok := s.auth.verify(req.Header.Get(HeaderToken), req.Host); ok {
+		s.crossWall(rw, req, user)
 		return
 	}
 	s.reverseProxy(rw, req)
 }
 
-func (s *FoolingServer) crossWall(rw http.ResponseWriter, req *http.Request) {
+func (s *FoolingServer) crossWall(rw http.ResponseWriter, req *http.Request, user string) {
 	var target net.Conn
 	var err error
 
@@ -56,9 +59,24 @@ func (s *FoolingServer) crossWall(rw http.ResponseWriter, req *http.Request) {
 		network = "tcp"
 	}
 
+	if network == NetworkUDPRelay {
+		targetAddr = ""
+	}
+
+	if err := s.users.check(user, targetAddr); err != nil {
+		logrus.Infof("%s user %s rejected to dial %s://%s: %v", req.RemoteAddr, user, network, targetAddr, err)
+		http.Error(rw, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	if network == NetworkUDPRelay {
+		s.relayUDP(rw, req, user)
+		return
+	}
+
 	dialer := new(net.Dialer)
 
-	logrus.Infof("%s dial %s://%s", req.RemoteAddr, network, targetAddr)
+	logrus.Infof("%s user %s dial %s://%s", req.RemoteAddr, user, network, targetAddr)
 
 	target, err = dialer.DialContext(req.Context(), network, targetAddr)
 	if err != nil {
@@ -69,21 +87,77 @@ func (s *FoolingServer) crossWall(rw http.ResponseWriter, req *http.Request) {
 
 	clean(req)
 
-	client, _, _ := rw.(http.Hijacker).Hijack()
-	if req.Method == http.MethodConnect {
-		client.Write([]byte(fmt.Sprintf("%s 200 OK\r\n\r\n", req.Proto)))
-	} else {
-		req.Write(target)
-	}
-
 	if network == "udp" || network == "udp4" || network == "udp6" {
 		target.SetReadDeadline(time.Now().Add(UDPReadTimeout))
 	}
 
+	client, err := s.hijack(rw, req)
+	if err != nil {
+		target.Close()
+		return
+	}
+
+	target = countingConn{Conn: target, user: user, users: s.users}
+
+	if req.Method != http.MethodConnect {
+		req.Write(target)
+	}
+
 	go utils.Exchange(client, target)
 	utils.Exchange(target, client)
 }
 
+func (s *FoolingServer) relayUDP(rw http.ResponseWriter, req *http.Request, user string) {
+	pc, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		logrus.Infof("%s failed to listen udp: %v", req.RemoteAddr, err)
+		http.Error(rw, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+
+	clean(req)
+
+	client, err := s.hijack(rw, req)
+	if err != nil {
+		pc.Close()
+		return
+	}
+
+	logrus.Infof("%s user %s relay udp via %s", req.RemoteAddr, user, pc.LocalAddr())
+
+	relayUDP(client, pc, req.RemoteAddr, user, s.users)
+}
+
+// hijack takes over the connection of an HTTP/1 request. A multiplexed
+// client opens a CONNECT stream of its HTTP/2 connection per target instead,
+// which is exchanged through the request body and the response.
+func (s *FoolingServer) hijack(rw http.ResponseWriter, req *http.Request) (io.ReadWriteCloser, error) {
+	if req.ProtoMajor != 2 {
+		client, _, err := rw.(http.Hijacker).Hijack()
+		if err != nil {
+			return nil, err
+		}
+		if req.Method == http.MethodConnect {
+			client.Write([]byte(fmt.Sprintf("%s 200 OK\r\n\r\n", req.Proto)))
+		}
+		return client, nil
+	}
+
+	flusher, ok := rw.(http.Flusher)
+	if !ok || req.Method != http.MethodConnect {
+		http.Error(rw, "only CONNECT is supported over HTTP/2", http.StatusMethodNotAllowed)
+		return nil, errors.New("unsupported HTTP/2 request")
+	}
+
+	rw.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	return &stream{
+		ReadCloser: req.Body,
+		w:          flushWriter{rw: rw, flusher: flusher},
+	}, nil
+}
+
 func (s *FoolingServer) reverseProxy(rw http.ResponseWriter, req *http.Request) {
 	logrus.Infof("serve the content of %s for %s", s.reversedWebsite, req.RemoteAddr)
 
@@ -107,7 +181,7 @@ func (s *FoolingServer) reverseProxy(rw http.ResponseWriter, req *http.Request)
 
 func clean(req *http.Request) {
 	req.Header.Del(HeaderNetwork)
-	req.Header.Del(HeaderSecret)
+	req.Header.Del(HeaderToken)
 }
 
 type rateLimitResponseWriter struct {
@@ -136,6 +210,26 @@ func (r *rateLimitResponseWriter) WriteHeader(statusCode int) {
 	r.rw.WriteHeader(statusCode)
 }
 
+type flushWriter struct {
+	rw      http.ResponseWriter
+	flusher http.Flusher
+}
+
+func (f flushWriter) Write(p []byte) (int, error) {
+	n, err := f.rw.Write(p)
+	f.flusher.Flush()
+	return n, err
+}
+
+type stream struct {
+	io.ReadCloser
+	w flushWriter
+}
+
+func (s *stream) Write(p []byte) (int, error) {
+	return s.w.Write(p)
+}
+
 func appendPort(host string, schema string) string {
 	if strings.Index(host, ":") < 0 || strings.HasSuffix(host, "]") {
 		if schema == "https" {
@@ -0,0 +1,284 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Dreamacro/clash/common/pool"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	NetworkUDPRelay = "udp-relay"
+
+	maxDatagramSize = 64 * 1024
+	relayTarget     = "0.0.0.0:0"
+
+	// maxDatagramHeaderSize is of LEN, ATYP and the longest DST.ADDR and
+	// DST.PORT, which keeps the datagrams within the pooled buffers.
+	maxDatagramHeaderSize = 2 + 1 + 1 + 255 + 2
+	maxPayloadSize        = maxDatagramSize - maxDatagramHeaderSize
+
+	// maxRelayPeers bounds the peers an association remembers.
+	maxRelayPeers = 4096
+)
+
+const (
+	atypIPv4   = 1
+	atypDomain = 3
+	atypIPv6   = 4
+)
+
+var errBadDatagram = errors.New("bad datagram")
+
+// PacketConn is one UDP association relayed through the server. Every
+// datagram carries its peer, so one association reaches many peers.
+type PacketConn interface {
+	ReadFrom(p []byte) (n int, addr string, err error)
+	WriteTo(p []byte, addr string) (n int, err error)
+	Close() error
+}
+
+type PacketClient interface {
+	ListenPacket(ctx context.Context) (PacketConn, error)
+}
+
+type relayConn struct {
+	conn   net.Conn
+	reader *bufio.Reader
+	mutex  sync.Mutex
+}
+
+func newRelayConn(conn net.Conn) *relayConn {
+	return &relayConn{
+		conn:   conn,
+		reader: bufio.NewReaderSize(conn, maxDatagramSize),
+	}
+}
+
+func (r *relayConn) ReadFrom(p []byte) (int, string, error) {
+	return readDatagram(r.reader, p)
+}
+
+func (r *relayConn) WriteTo(p []byte, addr string) (int, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if err := writeDatagram(r.conn, addr, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (r *relayConn) Close() error {
+	return r.conn.Close()
+}
+
+// Every datagram is framed as:
+//
+//	+-----+------+----------+----------+---------+
+//	| LEN | ATYP | DST.ADDR | DST.PORT | PAYLOAD |
+//	+-----+------+----------+----------+---------+
+//	|  2  |  1   | variable |    2     | LEN - * |
+//	+-----+------+----------+----------+---------+
+//
+// where ATYP and DST.ADDR are encoded as in SOCKS5.
+func writeDatagram(w io.Writer, addr string, p []byte) error {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	portNum, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return err
+	}
+	if len(p) > maxPayloadSize {
+		return errBadDatagram
+	}
+
+	buf := pool.Get(maxDatagramHeaderSize + len(p))
+	defer pool.Put(buf)
+
+	n := 2
+	if ip := net.ParseIP(host); ip == nil {
+		if len(host) > 255 {
+			return errBadDatagram
+		}
+		buf[n] = atypDomain
+		buf[n+1] = byte(len(host))
+		n += 2 + copy(buf[n+2:], host)
+	} else if ip4 := ip.To4(); ip4 != nil {
+		buf[n] = atypIPv4
+		n += 1 + copy(buf[n+1:], ip4)
+	} else {
+		buf[n] = atypIPv6
+		n += 1 + copy(buf[n+1:], ip.To16())
+	}
+	binary.BigEndian.PutUint16(buf[n:], uint16(portNum))
+	n += 2
+	n += copy(buf[n:], p)
+
+	binary.BigEndian.PutUint16(buf, uint16(n-2))
+
+	_, err = w.Write(buf[:n])
+	return err
+}
+
+func readDatagram(r io.Reader, p []byte) (int, string, error) {
+	var length [2]byte
+	if _, err := io.ReadFull(r, length[:]); err != nil {
+		return 0, "", err
+	}
+
+	buf := pool.Get(int(binary.BigEndian.Uint16(length[:])))
+	defer pool.Put(buf)
+
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return 0, "", err
+	}
+
+	var host string
+	var rest []byte
+	switch {
+	case len(buf) >= 1+net.IPv4len+2 && buf[0] == atypIPv4:
+		host = net.IP(buf[1 : 1+net.IPv4len]).String()
+		rest = buf[1+net.IPv4len:]
+	case len(buf) >= 1+net.IPv6len+2 && buf[0] == atypIPv6:
+		host = net.IP(buf[1 : 1+net.IPv6len]).String()
+		rest = buf[1+net.IPv6len:]
+	case len(buf) >= 2 && buf[0] == atypDomain && len(buf) >= 2+int(buf[1])+2:
+		host = string(buf[2 : 2+int(buf[1])])
+		rest = buf[2+int(buf[1]):]
+	default:
+		return 0, "", errBadDatagram
+	}
+
+	port := binary.BigEndian.Uint16(rest)
+	n := copy(p, rest[2:])
+	return n, net.JoinHostPort(host, strconv.Itoa(int(port))), nil
+}
+
+// relayUDP relays the datagrams of one association between the client and
+// the peers through a single unconnected socket, so that any peer can reach
+// the client back through the same mapped port.
+func relayUDP(client io.ReadWriteCloser, pc *net.UDPConn, remote, user string, users *UserStore) {
+	var once sync.Once
+	closeAll := func() {
+		once.Do(func() {
+			client.Close()
+			pc.Close()
+		})
+	}
+	defer closeAll()
+
+	var lastActive int64
+	touch := func() {
+		atomic.StoreInt64(&lastActive, time.Now().UnixNano())
+	}
+	touch()
+
+	go func() {
+		ticker := time.NewTicker(UDPReadTimeout / 2)
+		defer ticker.Stop()
+		for range ticker.C {
+			if time.Since(time.Unix(0, atomic.LoadInt64(&lastActive))) > UDPReadTimeout {
+				logrus.Infof("%s udp association is idle", remote)
+				closeAll()
+				return
+			}
+		}
+	}()
+
+	var mutex sync.Mutex
+	requested := make(map[string]string)
+
+	go func() {
+		defer closeAll()
+
+		buf := pool.Get(maxDatagramSize)
+		defer pool.Put(buf)
+
+		for {
+			n, from, err := pc.ReadFromUDP(buf[:maxPayloadSize])
+			if err != nil {
+				return
+			}
+			touch()
+			users.add(user, int64(n))
+
+			addr := from.String()
+			mutex.Lock()
+			if domain, ok := requested[addr]; ok {
+				addr = domain
+			}
+			mutex.Unlock()
+
+			if err := writeDatagram(client, addr, buf[:n]); err != nil {
+				return
+			}
+		}
+	}()
+
+	reader := bufio.NewReaderSize(client, maxDatagramSize)
+	resolved := make(map[string]*net.UDPAddr)
+
+	buf := pool.Get(maxDatagramSize)
+	defer pool.Put(buf)
+
+	for {
+		n, addr, err := readDatagram(reader, buf)
+		if err != nil {
+			return
+		}
+		touch()
+
+		if users.overQuota(user) {
+			logrus.Infof("%s user %s stopped relaying udp: %v", remote, user, errQuotaExceeded)
+			return
+		}
+
+		to, ok := resolved[addr]
+		if !ok {
+			// The peers are forgotten all at once, and those still in use
+			// are resolved again.
+			if len(resolved) >= maxRelayPeers {
+				resolved = make(map[string]*net.UDPAddr)
+				mutex.Lock()
+				requested = make(map[string]string)
+				mutex.Unlock()
+			}
+
+			if err := users.check(user, addr); err != nil {
+				logrus.Infof("%s user %s rejected to relay udp to %s: %v", remote, user, addr, err)
+				continue
+			}
+			if to, err = net.ResolveUDPAddr("udp", addr); err != nil {
+				logrus.Warnf("%s failed to resolve %s: %v", remote, addr, err)
+				continue
+			}
+			resolved[addr] = to
+
+			// Replies of a peer given by domain are sent back with the
+			// domain, which is how the client knows the peer.
+			if host, _, _ := net.SplitHostPort(addr); net.ParseIP(host) == nil {
+				mutex.Lock()
+				requested[to.String()] = addr
+				mutex.Unlock()
+			}
+		}
+
+		if _, err := pc.WriteToUDP(buf[:n], to); err != nil {
+			logrus.Debugf("%s failed to relay udp to %s: %v", remote, addr, err)
+			continue
+		}
+		users.add(user, int64(n))
+	}
+}
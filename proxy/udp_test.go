@@ -0,0 +1,75 @@
+package proxy
+
+import (
+	"bytes"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDatagramFraming(t *testing.T) {
+	var buf bytes.Buffer
+	addrs := []string{"1.2.3.4:53", "[2001:db8::1]:443", "example.com:8080"}
+	for _, addr := range addrs {
+		require.NoError(t, writeDatagram(&buf, addr, []byte(addr)))
+	}
+
+	p := make([]byte, maxDatagramSize)
+	for _, addr := range addrs {
+		n, from, err := readDatagram(&buf, p)
+		require.NoError(t, err)
+		require.Equal(t, addr, from)
+		require.Equal(t, addr, string(p[:n]))
+	}
+
+	host := strings.Repeat("a", 255)
+	require.NoError(t, writeDatagram(&buf, host+":53", make([]byte, maxPayloadSize)))
+	n, from, err := readDatagram(&buf, p)
+	require.NoError(t, err)
+	require.Equal(t, host+":53", from)
+	require.Equal(t, maxPayloadSize, n)
+
+	require.Equal(t, errBadDatagram, writeDatagram(&buf, "1.2.3.4:53", make([]byte, maxPayloadSize+1)))
+	require.Equal(t, errBadDatagram, writeDatagram(&buf, "1.2.3.4:53", make([]byte, maxDatagramSize)))
+}
+
+func TestRelayUDP(t *testing.T) {
+	peer, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	require.NoError(t, err)
+	defer peer.Close()
+	go func() {
+		buf := make([]byte, maxDatagramSize)
+		for {
+			n, from, err := peer.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			peer.WriteToUDP(buf[:n], from)
+		}
+	}()
+
+	pc, err := net.ListenUDP("udp", nil)
+	require.NoError(t, err)
+
+	client, server := net.Pipe()
+	go relayUDP(server, pc, "test", DefaultUser, NewStaticUserStore("key"))
+
+	conn := newRelayConn(client)
+	defer conn.Close()
+
+	target := peer.LocalAddr().String()
+	_, err = conn.WriteTo([]byte("first"), target)
+	require.NoError(t, err)
+	_, err = conn.WriteTo([]byte("second"), target)
+	require.NoError(t, err)
+
+	p := make([]byte, maxDatagramSize)
+	for _, expected := range []string{"first", "second"} {
+		n, from, err := conn.ReadFrom(p)
+		require.NoError(t, err)
+		require.Equal(t, target, from)
+		require.Equal(t, expected, string(p[:n]))
+	}
+}
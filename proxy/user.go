@@ -0,0 +1,335 @@
+package proxy
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	DefaultUser = "default"
+
+	usersReloadInterval = 5 * time.Second
+	usageSaveInterval   = time.Minute
+	usageFileSuffix     = ".usage"
+)
+
+var (
+	errQuotaExceeded  = errors.New("monthly quota exceeded")
+	errPortNotAllowed = errors.New("destination port is not allowed")
+)
+
+type User struct {
+	Name  string `json:"name"`
+	Key   string `json:"key"`
+	Quota int64  `json:"quota,omitempty"`
+	Ports []int  `json:"ports,omitempty"`
+}
+
+func (u *User) allowPort(port int) bool {
+	if len(u.Ports) == 0 {
+		return true
+	}
+	for _, p := range u.Ports {
+		if p == port {
+			return true
+		}
+	}
+	return false
+}
+
+type Usage struct {
+	Month string `json:"month"`
+	Bytes int64  `json:"bytes"`
+}
+
+func (u *Usage) ThisMonth() int64 {
+	if u == nil || u.Month != month() {
+		return 0
+	}
+	return atomic.LoadInt64(&u.Bytes)
+}
+
+// UserStore holds the users allowed to cross the wall with their monthly
+// usage. A store opened from a file reloads the users whenever the file
+// changes, and keeps the usage next to it.
+type UserStore struct {
+	path      string
+	mutex     sync.RWMutex
+	users     map[string]*User
+	usage     map[string]*Usage
+	modTime   time.Time
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func NewStaticUserStore(secretKey string) *UserStore {
+	return &UserStore{
+		users: map[string]*User{
+			DefaultUser: {Name: DefaultUser, Key: secretKey},
+		},
+		usage: make(map[string]*Usage),
+		done:  make(chan struct{}),
+	}
+}
+
+func OpenUserStore(path string) (*UserStore, error) {
+	s := &UserStore{
+		path:  path,
+		usage: make(map[string]*Usage),
+		done:  make(chan struct{}),
+	}
+	if err := s.reload(); err != nil {
+		return nil, err
+	}
+	if usage, err := LoadUsage(path); err == nil {
+		s.usage = usage
+	}
+
+	go s.watch()
+	return s, nil
+}
+
+func LoadUsers(path string) ([]*User, error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var users []*User
+	if err := json.Unmarshal(data, &users); err != nil {
+		return nil, err
+	}
+	return users, nil
+}
+
+func SaveUsers(path string, users []*User) error {
+	data, err := json.MarshalIndent(users, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, data, 0600)
+}
+
+func LoadUsage(path string) (map[string]*Usage, error) {
+	data, err := ioutil.ReadFile(path + usageFileSuffix)
+	if err != nil {
+		return nil, err
+	}
+
+	usage := make(map[string]*Usage)
+	if err := json.Unmarshal(data, &usage); err != nil {
+		return nil, err
+	}
+	return usage, nil
+}
+
+func (s *UserStore) key(name string) (string, bool) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	u, ok := s.users[name]
+	if !ok {
+		return "", false
+	}
+	return u.Key, true
+}
+
+// check reports why the user may not reach the target, if any.
+func (s *UserStore) check(name, target string) error {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	u, ok := s.users[name]
+	if !ok {
+		return errors.New("no such user")
+	}
+
+	if s.exceeded(u) {
+		return errQuotaExceeded
+	}
+
+	if _, port, err := net.SplitHostPort(target); err == nil {
+		if p, _ := strconv.Atoi(port); p != 0 && !u.allowPort(p) {
+			return errPortNotAllowed
+		}
+	}
+	return nil
+}
+
+// exceeded tells whether the user has used up the quota of this month, and
+// must be called with the lock held.
+func (s *UserStore) exceeded(u *User) bool {
+	return u.Quota > 0 && s.usage[u.Name].ThisMonth() >= u.Quota
+}
+
+// overQuota tells whether the user has used up the quota of this month.
+func (s *UserStore) overQuota(name string) bool {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	u, ok := s.users[name]
+	return ok && s.exceeded(u)
+}
+
+func (s *UserStore) add(name string, n int64) {
+	if n == 0 {
+		return
+	}
+
+	current := month()
+
+	s.mutex.RLock()
+	usage, ok := s.usage[name]
+	s.mutex.RUnlock()
+
+	if !ok || usage.Month != current {
+		s.mutex.Lock()
+		if usage, ok = s.usage[name]; !ok || usage.Month != current {
+			usage = &Usage{Month: current}
+			s.usage[name] = usage
+		}
+		s.mutex.Unlock()
+	}
+
+	atomic.AddInt64(&usage.Bytes, n)
+}
+
+func (s *UserStore) reload() error {
+	info, err := os.Stat(s.path)
+	if err != nil {
+		return err
+	}
+
+	users, err := LoadUsers(s.path)
+	if err != nil {
+		return err
+	}
+
+	m := make(map[string]*User, len(users))
+	for _, u := range users {
+		if !ValidUserName(u.Name) {
+			logrus.Warnf("skip invalid user name %q in %s", u.Name, s.path)
+			continue
+		}
+		m[u.Name] = u
+	}
+
+	s.mutex.Lock()
+	s.users = m
+	s.modTime = info.ModTime()
+	s.mutex.Unlock()
+
+	logrus.Infof("loaded %d users from %s", len(m), s.path)
+	return nil
+}
+
+func (s *UserStore) watch() {
+	reload := time.NewTicker(usersReloadInterval)
+	defer reload.Stop()
+	save := time.NewTicker(usageSaveInterval)
+	defer save.Stop()
+
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-reload.C:
+			info, err := os.Stat(s.path)
+			if err != nil {
+				logrus.Warnf("failed to stat users file %s: %v", s.path, err)
+				continue
+			}
+
+			s.mutex.RLock()
+			changed := !info.ModTime().Equal(s.modTime)
+			s.mutex.RUnlock()
+
+			if changed {
+				if err := s.reload(); err != nil {
+					logrus.Errorf("failed to reload users from %s: %v", s.path, err)
+				}
+			}
+		case <-save.C:
+			if err := s.saveUsage(); err != nil {
+				logrus.Errorf("failed to save usage of users: %v", err)
+			}
+		}
+	}
+}
+
+// Close stops watching the users file, and saves the usage of the users.
+func (s *UserStore) Close() error {
+	err := net.ErrClosed
+	s.closeOnce.Do(func() {
+		close(s.done)
+		err = nil
+		if s.path != "" {
+			err = s.saveUsage()
+		}
+	})
+	return err
+}
+
+func (s *UserStore) saveUsage() error {
+	s.mutex.RLock()
+	usage := make(map[string]*Usage, len(s.usage))
+	for name, u := range s.usage {
+		usage[name] = &Usage{Month: u.Month, Bytes: atomic.LoadInt64(&u.Bytes)}
+	}
+	s.mutex.RUnlock()
+
+	data, err := json.MarshalIndent(usage, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(s.path+usageFileSuffix, data, 0600)
+}
+
+func month() string {
+	return time.Now().Format("2006-01")
+}
+
+// ValidUserName reports whether the name can be carried by a token.
+func ValidUserName(name string) bool {
+	return name != "" && !strings.ContainsAny(name, ". \t\r\n")
+}
+
+// countingConn counts the traffic of the user, and is closed once the user
+// runs out of the quota.
+type countingConn struct {
+	net.Conn
+	user  string
+	users *UserStore
+}
+
+func (c countingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	return n, c.count(n, err)
+}
+
+func (c countingConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	return n, c.count(n, err)
+}
+
+func (c countingConn) count(n int, err error) error {
+	c.users.add(c.user, int64(n))
+	if err == nil && c.users.overQuota(c.user) {
+		c.Conn.Close()
+		return errQuotaExceeded
+	}
+	return err
+}
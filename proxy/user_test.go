@@ -0,0 +1,46 @@
+package proxy
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestUserStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "users")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "users.json")
+
+	require.NoError(t, SaveUsers(path, []*User{
+		{Name: "alice", Key: "a", Quota: 10},
+		{Name: "bad.name", Key: "b"},
+	}))
+	s, err := OpenUserStore(path)
+	require.NoError(t, err)
+
+	_, ok := s.key("bad.name")
+	require.False(t, ok)
+
+	// One stream runs out of the quota.
+	client, server := net.Pipe()
+	defer client.Close()
+	conn := countingConn{Conn: server, user: "alice", users: s}
+	go client.Write(make([]byte, 8))
+	_, err = conn.Read(make([]byte, 8))
+	require.NoError(t, err)
+	go client.Write(make([]byte, 8))
+	_, err = conn.Read(make([]byte, 8))
+	require.Equal(t, errQuotaExceeded, err)
+	require.Equal(t, errQuotaExceeded, s.check("alice", "1.1.1.1:443"))
+
+	require.NoError(t, s.Close())
+	require.Equal(t, net.ErrClosed, s.Close())
+	usage, err := LoadUsage(path)
+	require.NoError(t, err)
+	require.Equal(t, int64(16), usage["alice"].ThisMonth())
+}
@@ -0,0 +1,243 @@
+package rule
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/fanpei91/spn/ipdb"
+)
+
+const (
+	Direct = "DIRECT"
+	Reject = "REJECT"
+	Proxy  = "PROXY"
+)
+
+const (
+	TypeDomain        = "DOMAIN"
+	TypeDomainSuffix  = "DOMAIN-SUFFIX"
+	TypeDomainKeyword = "DOMAIN-KEYWORD"
+	TypeDomainRegex   = "DOMAIN-REGEX"
+	TypeIPCIDR        = "IP-CIDR"
+	TypeIPCIDR6       = "IP-CIDR6"
+	TypeGeoIP         = "GEOIP"
+	TypeDstPort       = "DST-PORT"
+	TypeNetwork       = "NETWORK"
+	TypeMatch         = "MATCH"
+)
+
+// Default keeps the private and China addresses direct and proxies the rest.
+var Default = []string{
+	"GEOIP,PRIVATE,DIRECT",
+	"GEOIP,CN,DIRECT",
+	"MATCH,PROXY",
+}
+
+var geoIP = map[string]*ipdb.IPRangeDB{
+	"CN":      ipdb.China,
+	"PRIVATE": ipdb.Private,
+	"LAN":     ipdb.Private,
+}
+
+// Metadata is what a connection is routed by. Host is the domain the
+// connection is known by, if any.
+type Metadata struct {
+	Network string
+	Host    string
+	IP      net.IP
+	Port    int
+}
+
+type Rule struct {
+	Type    string
+	Payload string
+	Target  string
+	match   func(m *Metadata) bool
+}
+
+func (r *Rule) String() string {
+	if r.Type == TypeMatch {
+		return r.Type + "," + r.Target
+	}
+	return r.Type + "," + r.Payload + "," + r.Target
+}
+
+func (r *Rule) Match(m *Metadata) bool {
+	return r.match(m)
+}
+
+func Parse(line string) (*Rule, error) {
+	parts := strings.Split(line, ",")
+	for i := range parts {
+		parts[i] = strings.TrimSpace(parts[i])
+	}
+
+	r := &Rule{Type: strings.ToUpper(parts[0])}
+	if r.Type == TypeMatch {
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid rule %q", line)
+		}
+		r.Target = parts[1]
+		r.match = func(*Metadata) bool { return true }
+		return r, nil
+	}
+
+	if len(parts) != 3 || parts[1] == "" || parts[2] == "" {
+		return nil, fmt.Errorf("invalid rule %q", line)
+	}
+	r.Payload, r.Target = parts[1], parts[2]
+
+	payload := strings.ToLower(strings.TrimSuffix(r.Payload, "."))
+	switch r.Type {
+	case TypeDomain:
+		r.match = func(m *Metadata) bool {
+			return host(m) == payload
+		}
+	case TypeDomainSuffix:
+		r.match = func(m *Metadata) bool {
+			h := host(m)
+			return h == payload || strings.HasSuffix(h, "."+payload)
+		}
+	case TypeDomainKeyword:
+		r.match = func(m *Metadata) bool {
+			h := host(m)
+			return h != "" && strings.Contains(h, payload)
+		}
+	case TypeDomainRegex:
+		re, err := regexp.Compile(r.Payload)
+		if err != nil {
+			return nil, fmt.Errorf("invalid rule %q: %v", line, err)
+		}
+		r.match = func(m *Metadata) bool {
+			h := host(m)
+			return h != "" && re.MatchString(h)
+		}
+	case TypeIPCIDR, TypeIPCIDR6:
+		_, ipNet, err := net.ParseCIDR(r.Payload)
+		if err != nil {
+			return nil, fmt.Errorf("invalid rule %q: %v", line, err)
+		}
+		r.match = func(m *Metadata) bool {
+			return m.IP != nil && ipNet.Contains(m.IP)
+		}
+	case TypeGeoIP:
+		db, ok := geoIP[strings.ToUpper(r.Payload)]
+		if !ok {
+			return nil, fmt.Errorf("invalid rule %q: unsupported country", line)
+		}
+		r.match = func(m *Metadata) bool {
+			return db.Contains(m.IP)
+		}
+	case TypeDstPort:
+		min, max, err := parsePortRange(r.Payload)
+		if err != nil {
+			return nil, fmt.Errorf("invalid rule %q: %v", line, err)
+		}
+		r.match = func(m *Metadata) bool {
+			return m.Port >= min && m.Port <= max
+		}
+	case TypeNetwork:
+		r.match = func(m *Metadata) bool {
+			return strings.HasPrefix(m.Network, payload)
+		}
+	default:
+		return nil, fmt.Errorf("invalid rule %q: unknown type", line)
+	}
+
+	return r, nil
+}
+
+func host(m *Metadata) string {
+	return strings.ToLower(strings.TrimSuffix(m.Host, "."))
+}
+
+func parsePortRange(s string) (int, int, error) {
+	parts := strings.SplitN(s, "-", 2)
+	min, err := strconv.ParseUint(parts[0], 10, 16)
+	if err != nil {
+		return 0, 0, err
+	}
+	max := min
+	if len(parts) == 2 {
+		if max, err = strconv.ParseUint(parts[1], 10, 16); err != nil {
+			return 0, 0, err
+		}
+	}
+	if min > max {
+		return 0, 0, errors.New("bad port range")
+	}
+	return int(min), int(max), nil
+}
+
+// Engine matches a connection against the rules in order. When nothing
+// matches, the connection is proxied.
+type Engine struct {
+	rules    []*Rule
+	fallback *Rule
+}
+
+func NewEngine(lines []string) (*Engine, error) {
+	e := &Engine{
+		fallback: &Rule{Type: TypeMatch, Target: Proxy, match: func(*Metadata) bool { return true }},
+	}
+
+	for _, line := range lines {
+		if line = strings.TrimSpace(line); line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		r, err := Parse(line)
+		if err != nil {
+			return nil, err
+		}
+		e.rules = append(e.rules, r)
+	}
+	return e, nil
+}
+
+func Load(path string) (*Engine, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var lines []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return NewEngine(lines)
+}
+
+func (e *Engine) Match(m *Metadata) *Rule {
+	for _, r := range e.rules {
+		if r.match(m) {
+			return r
+		}
+	}
+	return e.fallback
+}
+
+// Targets returns the targets the rules refer to.
+func (e *Engine) Targets() []string {
+	seen := make(map[string]bool)
+	var targets []string
+	for _, r := range append(e.rules, e.fallback) {
+		if !seen[r.Target] {
+			seen[r.Target] = true
+			targets = append(targets, r.Target)
+		}
+	}
+	return targets
+}
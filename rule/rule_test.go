@@ -0,0 +1,47 @@
+package rule
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestEngine(t *testing.T) {
+	e, err := NewEngine([]string{
+		"# comment",
+		"DOMAIN,exact.com,DIRECT",
+		"DOMAIN-SUFFIX,google.com,PROXY",
+		"DOMAIN-KEYWORD,ads,REJECT",
+		`DOMAIN-REGEX,^cdn\d+\.example\.org$,DIRECT`,
+		"IP-CIDR,10.0.0.0/8,REJECT",
+		"DST-PORT,6881-6889,DIRECT",
+		"NETWORK,udp,PROXY",
+		"GEOIP,CN,DIRECT",
+		"MATCH,PROXY",
+	})
+	require.NoError(t, err)
+
+	cases := []struct {
+		m    Metadata
+		rule string
+	}{
+		{Metadata{Network: "tcp", Host: "exact.com.", Port: 443}, "DOMAIN,exact.com,DIRECT"},
+		{Metadata{Network: "tcp", Host: "www.google.com", Port: 443}, "DOMAIN-SUFFIX,google.com,PROXY"},
+		{Metadata{Network: "tcp", Host: "notgoogle.com", IP: net.ParseIP("8.8.8.8"), Port: 443}, "MATCH,PROXY"},
+		{Metadata{Network: "tcp", Host: "ads.tracker.net", Port: 80}, "DOMAIN-KEYWORD,ads,REJECT"},
+		{Metadata{Network: "tcp", Host: "cdn12.example.org", Port: 80}, `DOMAIN-REGEX,^cdn\d+\.example\.org$,DIRECT`},
+		{Metadata{Network: "tcp", IP: net.ParseIP("10.1.2.3"), Port: 80}, "IP-CIDR,10.0.0.0/8,REJECT"},
+		{Metadata{Network: "tcp", IP: net.ParseIP("8.8.8.8"), Port: 6885}, "DST-PORT,6881-6889,DIRECT"},
+		{Metadata{Network: "udp", IP: net.ParseIP("180.101.49.11"), Port: 443}, "NETWORK,udp,PROXY"},
+		{Metadata{Network: "tcp", IP: net.ParseIP("180.101.49.11"), Port: 443}, "GEOIP,CN,DIRECT"},
+	}
+	for _, c := range cases {
+		require.Equal(t, c.rule, e.Match(&c.m).String(), "%+v", c.m)
+	}
+
+	_, err = NewEngine([]string{"GEOIP,US,DIRECT"})
+	require.Error(t, err)
+	_, err = NewEngine([]string{"DOMAIN,google.com"})
+	require.Error(t, err)
+}
@@ -0,0 +1,63 @@
+package sniff
+
+import (
+	"bytes"
+	"net"
+	"strings"
+)
+
+var methods = []string{"GET", "POST", "HEAD", "PUT", "DELETE", "OPTIONS", "PATCH", "CONNECT", "TRACE"}
+
+// HTTP sniffs the host of the Host header of the HTTP/1 request.
+func HTTP(b []byte) (string, error) {
+	if !hasMethod(b) {
+		return "", errNotFound
+	}
+
+	end := bytes.Index(b, []byte("\r\n\r\n"))
+	header := b
+	if end >= 0 {
+		header = b[:end]
+	}
+
+	lines := strings.Split(string(header), "\r\n")
+	if end < 0 {
+		// The last line may be cut.
+		lines = lines[:len(lines)-1]
+	}
+	if len(lines) > 0 {
+		lines = lines[1:]
+	}
+	for _, line := range lines {
+		i := strings.IndexByte(line, ':')
+		if i < 0 || !strings.EqualFold(strings.TrimSpace(line[:i]), "Host") {
+			continue
+		}
+
+		host := strings.TrimSpace(line[i+1:])
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		return domain(host)
+	}
+
+	if end < 0 {
+		return "", errIncomplete
+	}
+	return "", errNotFound
+}
+
+// hasMethod tells whether the bytes start with a method followed by a
+// space, or may do with more of them.
+func hasMethod(b []byte) bool {
+	for _, method := range methods {
+		n := len(method) + 1
+		if len(b) < n {
+			n = len(b)
+		}
+		if bytes.Equal(b[:n], []byte(method + " ")[:n]) {
+			return true
+		}
+	}
+	return false
+}
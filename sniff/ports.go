@@ -0,0 +1,44 @@
+package sniff
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// DefaultPorts are those of HTTP, HTTPS and QUIC, which the clients speak
+// first on.
+const DefaultPorts = "tcp/80,tcp/443,udp/443"
+
+// Ports are the destination ports sniffed, by network.
+type Ports map[string]bool
+
+// ParsePorts parses the comma separated network/port pairs, e.g.
+// tcp/443,udp/443.
+func ParsePorts(s string) (Ports, error) {
+	ports := make(Ports)
+	for _, p := range strings.Split(s, ",") {
+		if p = strings.TrimSpace(p); p == "" {
+			continue
+		}
+
+		i := strings.IndexByte(p, '/')
+		if i < 0 {
+			return nil, fmt.Errorf("invalid sniff port %q", p)
+		}
+		network := strings.ToLower(p[:i])
+		if network != "tcp" && network != "udp" {
+			return nil, fmt.Errorf("invalid sniff port %q", p)
+		}
+		port, err := strconv.ParseUint(p[i+1:], 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("invalid sniff port %q", p)
+		}
+		ports[network+"/"+strconv.Itoa(int(port))] = true
+	}
+	return ports, nil
+}
+
+func (p Ports) Contains(network string, port int) bool {
+	return p[network+"/"+strconv.Itoa(port)]
+}
@@ -0,0 +1,254 @@
+package sniff
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"sort"
+)
+
+const (
+	frameTypePadding          = 0x00
+	frameTypePing             = 0x01
+	frameTypeACK              = 0x02
+	frameTypeACKECN           = 0x03
+	frameTypeCrypto           = 0x06
+	headerProtectionSampleLen = 16
+)
+
+// quicVersion tells how the Initial packets of a QUIC version are protected.
+type quicVersion struct {
+	salt        []byte
+	keyLabel    string
+	ivLabel     string
+	hpLabel     string
+	initialType byte
+}
+
+var quicV1 = quicVersion{
+	salt:     []byte{0x38, 0x76, 0x2c, 0xf7, 0xf5, 0x59, 0x34, 0xb3, 0x4d, 0x17, 0x9a, 0xe6, 0xa4, 0xc8, 0x0c, 0xad, 0xcc, 0xbb, 0x7f, 0x0a},
+	keyLabel: "quic key",
+	ivLabel:  "quic iv",
+	hpLabel:  "quic hp",
+}
+
+var quicVersions = map[uint32]quicVersion{
+	// RFC 9001
+	0x00000001: quicV1,
+	// RFC 9369
+	0x6b3343cf: {
+		salt:        []byte{0x0d, 0xed, 0xe3, 0xde, 0xf7, 0x00, 0xa6, 0xdb, 0x81, 0x93, 0x81, 0xbe, 0x6e, 0x26, 0x9d, 0xcb, 0xf9, 0xbd, 0x2e, 0xd9},
+		keyLabel:    "quicv2 key",
+		ivLabel:     "quicv2 iv",
+		hpLabel:     "quicv2 hp",
+		initialType: 0x01,
+	},
+	// draft-29
+	0xff00001d: {
+		salt:     []byte{0xaf, 0xbf, 0xec, 0x28, 0x99, 0x93, 0xd2, 0x4c, 0x9e, 0x97, 0x86, 0xf1, 0x9c, 0x61, 0x11, 0xe0, 0x43, 0x90, 0xa8, 0x99},
+		keyLabel: "quic key",
+		ivLabel:  "quic iv",
+		hpLabel:  "quic hp",
+	},
+}
+
+type cryptoFrame struct {
+	offset int
+	data   []byte
+}
+
+// QUIC sniffs the server name of the ClientHello in the CRYPTO frames of
+// the client Initial packets, which may span many datagrams.
+func QUIC(datagrams [][]byte) (string, error) {
+	var frames []cryptoFrame
+	for i, datagram := range datagrams {
+		found, err := initialFrames(datagram, &frames)
+		if err != nil {
+			return "", err
+		}
+		if !found && i == 0 {
+			return "", errNotFound
+		}
+	}
+
+	sort.Slice(frames, func(i, j int) bool {
+		return frames[i].offset < frames[j].offset
+	})
+	var hello []byte
+	for _, f := range frames {
+		if f.offset > len(hello) {
+			break
+		}
+		if end := f.offset + len(f.data); end > len(hello) {
+			hello = append(hello, f.data[len(hello)-f.offset:]...)
+		}
+	}
+	return clientHello(hello)
+}
+
+// initialFrames collects the CRYPTO frames of the Initial packets coalesced
+// in the datagram, and tells whether there are any of them.
+func initialFrames(datagram []byte, frames *[]cryptoFrame) (bool, error) {
+	found := false
+	for len(datagram) > 0 {
+		payload, rest, ok := openInitial(datagram)
+		if !ok {
+			break
+		}
+		found = true
+		datagram = rest
+
+		if err := cryptoFrames(payload, frames); err != nil {
+			return found, err
+		}
+	}
+	return found, nil
+}
+
+// openInitial removes the protection of the client Initial packet at the
+// start of the datagram, and returns its payload and the packets after it.
+// The datagram is left as it is.
+func openInitial(datagram []byte) (payload, rest []byte, ok bool) {
+	// The long header form.
+	if len(datagram) < 5 || datagram[0]&0x80 == 0 {
+		return nil, nil, false
+	}
+	version, ok := quicVersions[binary.BigEndian.Uint32(datagram[1:5])]
+	if !ok || (datagram[0]>>4)&0x03 != version.initialType {
+		return nil, nil, false
+	}
+
+	r := reader(datagram[5:])
+	dcid := r.bytes(r.uint8())
+	r.skip(r.uint8())
+	tokenLen, ok1 := r.varint()
+	r.skip(int(tokenLen))
+	length, ok2 := r.varint()
+	if !ok1 || !ok2 || len(dcid) == 0 || length > uint64(len(r)) {
+		return nil, nil, false
+	}
+
+	pnOffset := len(datagram) - len(r)
+	end := pnOffset + int(length)
+	if pnOffset+4+headerProtectionSampleLen > end {
+		return nil, nil, false
+	}
+
+	secret := hkdfExpandLabel(hkdfExtract(version.salt, dcid), "client in", sha256.Size)
+	key := hkdfExpandLabel(secret, version.keyLabel, 16)
+	iv := hkdfExpandLabel(secret, version.ivLabel, 12)
+	hp := hkdfExpandLabel(secret, version.hpLabel, 16)
+
+	block, err := aes.NewCipher(hp)
+	if err != nil {
+		return nil, nil, false
+	}
+	mask := make([]byte, aes.BlockSize)
+	block.Encrypt(mask, datagram[pnOffset+4:pnOffset+4+headerProtectionSampleLen])
+
+	header := append([]byte(nil), datagram[:pnOffset+4]...)
+	header[0] ^= mask[0] & 0x0f
+	pnLen := int(header[0]&0x03) + 1
+	var pn uint64
+	for i := 0; i < pnLen; i++ {
+		header[pnOffset+i] ^= mask[1+i]
+		pn = pn<<8 | uint64(header[pnOffset+i])
+	}
+	header = header[:pnOffset+pnLen]
+
+	nonce := append([]byte(nil), iv...)
+	for i := 0; i < 8; i++ {
+		nonce[len(nonce)-1-i] ^= byte(pn >> (8 * i))
+	}
+
+	block, err = aes.NewCipher(key)
+	if err != nil {
+		return nil, nil, false
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, nil, false
+	}
+	payload, err = aead.Open(nil, nonce, datagram[pnOffset+pnLen:end], header)
+	if err != nil {
+		return nil, nil, false
+	}
+	return payload, datagram[end:], true
+}
+
+// cryptoFrames collects the CRYPTO frames of the payload, skipping those
+// which may come along in the client Initial packets.
+func cryptoFrames(payload []byte, frames *[]cryptoFrame) error {
+	r := reader(payload)
+	for len(r) > 0 {
+		typ, _ := r.varint()
+		switch typ {
+		case frameTypePadding, frameTypePing:
+		case frameTypeACK, frameTypeACKECN:
+			r.varint()
+			r.varint()
+			ranges, _ := r.varint()
+			r.varint()
+			for i := uint64(0); i < ranges && len(r) > 0; i++ {
+				r.varint()
+				r.varint()
+			}
+			if typ == frameTypeACKECN {
+				r.varint()
+				r.varint()
+				r.varint()
+			}
+		case frameTypeCrypto:
+			offset, _ := r.varint()
+			length, ok := r.varint()
+			if !ok || length > uint64(len(r)) || offset > maxClientHelloLen {
+				return errNotFound
+			}
+			*frames = append(*frames, cryptoFrame{offset: int(offset), data: r.bytes(int(length))})
+		default:
+			return errNotFound
+		}
+	}
+	return nil
+}
+
+// varint reads the variable-length integer of QUIC.
+func (r *reader) varint() (uint64, bool) {
+	if len(*r) == 0 {
+		return 0, false
+	}
+	n := 1 << ((*r)[0] >> 6)
+	b := r.bytes(n)
+	if len(b) < n {
+		return 0, false
+	}
+
+	v := uint64(b[0] & 0x3f)
+	for _, c := range b[1:] {
+		v = v<<8 | uint64(c)
+	}
+	return v, true
+}
+
+func hkdfExtract(salt, secret []byte) []byte {
+	h := hmac.New(sha256.New, salt)
+	h.Write(secret)
+	return h.Sum(nil)
+}
+
+// hkdfExpandLabel is HKDF-Expand-Label of TLS 1.3 with no context, which is
+// of one block as the length is at most the size of SHA-256.
+func hkdfExpandLabel(secret []byte, label string, length int) []byte {
+	label = "tls13 " + label
+	info := make([]byte, 0, 4+len(label))
+	info = append(info, byte(length>>8), byte(length), byte(len(label)))
+	info = append(info, label...)
+	info = append(info, 0)
+
+	h := hmac.New(sha256.New, secret)
+	h.Write(info)
+	h.Write([]byte{1})
+	return h.Sum(nil)[:length]
+}
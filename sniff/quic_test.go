@@ -0,0 +1,113 @@
+package sniff
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestQUICKeys(t *testing.T) {
+	// RFC 9001 A.1
+	dcid, _ := hex.DecodeString("8394c8f03e515708")
+	secret := hkdfExpandLabel(hkdfExtract(quicV1.salt, dcid), "client in", sha256.Size)
+	require.Equal(t, "c00cf151ca5be075ed0ebfb5c80323c42d6b7db67881289af4008f1f6c357aea", hex.EncodeToString(secret))
+	require.Equal(t, "1f369613dd76d5467730efcbe3b1a22d", hex.EncodeToString(hkdfExpandLabel(secret, "quic key", 16)))
+	require.Equal(t, "fa044b2f42a3fd3b46fb255c", hex.EncodeToString(hkdfExpandLabel(secret, "quic iv", 12)))
+	require.Equal(t, "9f50449e04a0e810283a1e9933adedd2", hex.EncodeToString(hkdfExpandLabel(secret, "quic hp", 16)))
+}
+
+func appendVarint(b []byte, v uint64) []byte {
+	switch {
+	case v < 1<<6:
+		return append(b, byte(v))
+	case v < 1<<14:
+		return append(b, 0x40|byte(v>>8), byte(v))
+	default:
+		return append(b, 0x80|byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+	}
+}
+
+func appendCrypto(offset int, data []byte) []byte {
+	b := appendVarint([]byte{frameTypeCrypto}, uint64(offset))
+	b = appendVarint(b, uint64(len(data)))
+	return append(b, data...)
+}
+
+// sealInitial protects the payload as the client Initial packet of the
+// version with a packet number of 2 bytes.
+func sealInitial(t *testing.T, version uint32, pn uint16, payload []byte) []byte {
+	v := quicVersions[version]
+	dcid := []byte{1, 2, 3, 4, 5, 6, 7, 8}
+	secret := hkdfExpandLabel(hkdfExtract(v.salt, dcid), "client in", sha256.Size)
+
+	packet := []byte{0xc0 | v.initialType<<4 | 0x01, 0, 0, 0, 0}
+	binary.BigEndian.PutUint32(packet[1:], version)
+	packet = append(packet, byte(len(dcid)))
+	packet = append(packet, dcid...)
+	packet = append(packet, 0, 0)
+	packet = appendVarint(packet, uint64(2+len(payload)+16))
+	pnOffset := len(packet)
+	packet = append(packet, byte(pn>>8), byte(pn))
+
+	nonce := hkdfExpandLabel(secret, v.ivLabel, 12)
+	nonce[10] ^= byte(pn >> 8)
+	nonce[11] ^= byte(pn)
+	block, err := aes.NewCipher(hkdfExpandLabel(secret, v.keyLabel, 16))
+	require.NoError(t, err)
+	aead, err := cipher.NewGCM(block)
+	require.NoError(t, err)
+	packet = aead.Seal(packet, nonce, payload, packet)
+
+	block, err = aes.NewCipher(hkdfExpandLabel(secret, v.hpLabel, 16))
+	require.NoError(t, err)
+	mask := make([]byte, aes.BlockSize)
+	block.Encrypt(mask, packet[pnOffset+4:pnOffset+4+headerProtectionSampleLen])
+	packet[0] ^= mask[0] & 0x0f
+	packet[pnOffset] ^= mask[1]
+	packet[pnOffset+1] ^= mask[2]
+	return packet
+}
+
+func TestQUIC(t *testing.T) {
+	hello := clientHelloRecord(t, "www.example.com")[recordHeaderLen:]
+	half := len(hello) / 2
+
+	for _, version := range []uint32{0x00000001, 0x6b3343cf, 0xff00001d} {
+		// The ClientHello is split into frames out of order, and into two
+		// packets, as browsers do.
+		first := []byte{frameTypePing}
+		first = append(first, appendCrypto(half/2, hello[half/2:half])...)
+		first = append(first, appendCrypto(0, hello[:half/2])...)
+		first = append(first, make([]byte, 64)...)
+		second := appendCrypto(half, hello[half:])
+
+		p1 := sealInitial(t, version, 0, first)
+		p2 := sealInitial(t, version, 1, second)
+		copied := append([]byte(nil), p1...)
+
+		_, err := QUIC([][]byte{p1})
+		require.Equal(t, errIncomplete, err)
+		require.Equal(t, copied, p1)
+
+		host, err := QUIC([][]byte{p1, p2})
+		require.NoError(t, err)
+		require.Equal(t, "www.example.com", host)
+
+		host, err = QUIC([][]byte{append(append([]byte(nil), p1...), p2...)})
+		require.NoError(t, err)
+		require.Equal(t, "www.example.com", host)
+	}
+
+	_, err := QUIC([][]byte{{0x01, 0x02, 0x03}})
+	require.Equal(t, errNotFound, err)
+
+	p := sealInitial(t, 1, 0, appendCrypto(0, hello))
+	p[len(p)-1] ^= 0xff
+	_, err = QUIC([][]byte{p})
+	require.Equal(t, errNotFound, err)
+}
@@ -0,0 +1,103 @@
+package sniff
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/Dreamacro/clash/common/pool"
+)
+
+const (
+	maxReads        = 8
+	maxStream       = 16 * 1024
+	maxDatagramSize = 64 * 1024
+)
+
+var (
+	errIncomplete = errors.New("incomplete")
+	errNotFound   = errors.New("domain not found")
+)
+
+// Conn reads the first bytes of the connection until the domain is sniffed
+// from the TLS ClientHello or the HTTP request over TCP, or from the QUIC
+// Initial packets over UDP, which gives up after the timeout. The returned
+// connection reads them again.
+func Conn(conn net.Conn, timeout time.Duration) (net.Conn, string) {
+	udp := conn.RemoteAddr().Network() == "udp"
+
+	size := pool.RelayBufferSize
+	if udp {
+		size = maxDatagramSize
+	}
+	buf := pool.Get(size)
+	defer pool.Put(buf)
+
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	defer conn.SetReadDeadline(time.Time{})
+
+	var reads [][]byte
+	var host string
+	var stream []byte
+	for len(reads) < maxReads {
+		n, err := conn.Read(buf)
+		if n > 0 {
+			reads = append(reads, append([]byte(nil), buf[:n]...))
+		}
+		if err != nil {
+			break
+		}
+
+		var sniffErr error
+		if udp {
+			host, sniffErr = QUIC(reads)
+		} else {
+			stream = append(stream, buf[:n]...)
+			host, sniffErr = Stream(stream)
+		}
+		if sniffErr != errIncomplete || len(stream) > maxStream {
+			break
+		}
+	}
+
+	return &replayConn{Conn: conn, reads: reads}, host
+}
+
+// Stream sniffs the domain of a TLS ClientHello or an HTTP request.
+func Stream(b []byte) (string, error) {
+	host, err := TLS(b)
+	if err != errNotFound || (len(b) > 0 && b[0] == recordTypeHandshake) {
+		return host, err
+	}
+	return HTTP(b)
+}
+
+// replayConn reads what has been read before the connection.
+type replayConn struct {
+	net.Conn
+	reads [][]byte
+}
+
+func (c *replayConn) Read(b []byte) (int, error) {
+	if len(c.reads) == 0 {
+		return c.Conn.Read(b)
+	}
+
+	n := copy(b, c.reads[0])
+	if n < len(c.reads[0]) {
+		c.reads[0] = c.reads[0][n:]
+	} else {
+		c.reads = c.reads[1:]
+	}
+	return n, nil
+}
+
+// domain makes a host name found in the bytes a domain, which is not an IP.
+func domain(host string) (string, error) {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	if host == "" || net.ParseIP(host) != nil {
+		return "", errNotFound
+	}
+	return host, nil
+}
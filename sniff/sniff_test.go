@@ -0,0 +1,159 @@
+package sniff
+
+import (
+	"crypto/tls"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// clientHelloRecord is the TLS record of the ClientHello of crypto/tls.
+func clientHelloRecord(t *testing.T, serverName string) []byte {
+	client, server := net.Pipe()
+	defer server.Close()
+	go tls.Client(client, &tls.Config{ServerName: serverName, InsecureSkipVerify: true}).Handshake()
+
+	record := make([]byte, recordHeaderLen)
+	_, err := io.ReadFull(server, record)
+	require.NoError(t, err)
+	n := int(record[3])<<8 | int(record[4])
+	record = append(record, make([]byte, n)...)
+	_, err = io.ReadFull(server, record[recordHeaderLen:])
+	require.NoError(t, err)
+	return record
+}
+
+func TestTLS(t *testing.T) {
+	record := clientHelloRecord(t, "www.Example.com")
+
+	host, err := TLS(record)
+	require.NoError(t, err)
+	require.Equal(t, "www.example.com", host)
+
+	for _, n := range []int{0, 3, recordHeaderLen, len(record) / 2, len(record) - 1} {
+		_, err = TLS(record[:n])
+		require.Equal(t, errIncomplete, err)
+	}
+
+	// The ClientHello fragmented into two records.
+	hello := record[recordHeaderLen:]
+	half := len(hello) / 2
+	fragmented := append([]byte{recordTypeHandshake, 3, 1, byte(half >> 8), byte(half)}, hello[:half]...)
+	rest := len(hello) - half
+	fragmented = append(fragmented, recordTypeHandshake, 3, 1, byte(rest>>8), byte(rest))
+	fragmented = append(fragmented, hello[half:]...)
+	host, err = TLS(fragmented)
+	require.NoError(t, err)
+	require.Equal(t, "www.example.com", host)
+
+	_, err = TLS(clientHelloRecord(t, ""))
+	require.Equal(t, errNotFound, err)
+	_, err = TLS([]byte("GET / HTTP/1.1\r\n"))
+	require.Equal(t, errNotFound, err)
+}
+
+func TestHTTP(t *testing.T) {
+	for _, c := range []struct {
+		request string
+		host    string
+		err     error
+	}{
+		{"GET / HTTP/1.1\r\nHost: example.com\r\n\r\n", "example.com", nil},
+		{"POST /a HTTP/1.1\r\nUser-Agent: curl\r\nhost:Example.com:8080\r\n\r\nbody", "example.com", nil},
+		{"GET / HTTP/1.1\r\nUser-Agent: curl\r\nHost: example.com", "", errIncomplete},
+		{"GET / HTTP/1.1\r\nHost: example.com\r\n", "example.com", nil},
+		{"GET / HTTP/1.1\r\nHost: [::1]:80\r\n\r\n", "", errNotFound},
+		{"GET / HTTP/1.0\r\n\r\n", "", errNotFound},
+		{"GE", "", errIncomplete},
+		{"SSH-2.0-OpenSSH_8.4\r\n", "", errNotFound},
+	} {
+		host, err := HTTP([]byte(c.request))
+		require.Equal(t, c.err, err, c.request)
+		require.Equal(t, c.host, host, c.request)
+	}
+}
+
+type udpConn struct {
+	net.Conn
+}
+
+func (udpConn) RemoteAddr() net.Addr {
+	return &net.UDPAddr{IP: net.IPv4(1, 1, 1, 1), Port: 443}
+}
+
+func TestConn(t *testing.T) {
+	record := clientHelloRecord(t, "example.com")
+
+	client, server := net.Pipe()
+	go func() {
+		client.Write(record[:10])
+		client.Write(record[10:])
+		client.Write([]byte("data"))
+		client.Close()
+	}()
+
+	conn, host := Conn(server, time.Second)
+	require.Equal(t, "example.com", host)
+	data, err := ioutil.ReadAll(conn)
+	require.NoError(t, err)
+	require.Equal(t, append(append([]byte(nil), record...), "data"...), data)
+}
+
+func TestConnTimeout(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+
+	start := time.Now()
+	conn, host := Conn(server, 50*time.Millisecond)
+	require.Empty(t, host)
+	require.True(t, time.Since(start) >= 50*time.Millisecond)
+
+	// The server speaks first, and the deadline is gone.
+	go client.Write([]byte("220 smtp.example.com\r\n"))
+	buf := make([]byte, 64)
+	n, err := conn.Read(buf)
+	require.NoError(t, err)
+	require.Equal(t, "220 smtp.example.com\r\n", string(buf[:n]))
+}
+
+func TestConnUDP(t *testing.T) {
+	client, server := net.Pipe()
+	go func() {
+		client.Write([]byte{0x01, 0x02})
+		client.Write([]byte{0x03})
+	}()
+
+	conn, host := Conn(udpConn{server}, time.Second)
+	require.Empty(t, host)
+
+	buf := make([]byte, 64)
+	n, err := conn.Read(buf)
+	require.NoError(t, err)
+	require.Equal(t, []byte{0x01, 0x02}, buf[:n])
+	n, err = conn.Read(buf)
+	require.NoError(t, err)
+	require.Equal(t, []byte{0x03}, buf[:n])
+}
+
+func TestParsePorts(t *testing.T) {
+	ports, err := ParsePorts(DefaultPorts)
+	require.NoError(t, err)
+	require.True(t, ports.Contains("tcp", 443))
+	require.True(t, ports.Contains("udp", 443))
+	require.True(t, ports.Contains("tcp", 80))
+	require.False(t, ports.Contains("udp", 80))
+	require.False(t, ports.Contains("tcp", 25))
+
+	ports, err = ParsePorts("")
+	require.NoError(t, err)
+	require.Empty(t, ports)
+
+	for _, s := range []string{"443", "sctp/443", "tcp/http", "tcp/65536"} {
+		_, err := ParsePorts(s)
+		require.Error(t, err, s)
+	}
+}
@@ -0,0 +1,121 @@
+package sniff
+
+const (
+	recordTypeHandshake      = 0x16
+	handshakeTypeClientHello = 0x01
+	extensionServerName      = 0x00
+	serverNameTypeHostName   = 0x00
+	recordHeaderLen          = 5
+	handshakeHeaderLen       = 4
+	maxClientHelloLen        = 1 << 16
+)
+
+// TLS sniffs the server name of the ClientHello in the TLS records, which
+// may be fragmented into many.
+func TLS(b []byte) (string, error) {
+	var hello []byte
+	for len(hello) < maxClientHelloLen {
+		if len(b) == 0 {
+			return "", errIncomplete
+		}
+		if b[0] != recordTypeHandshake {
+			return "", errNotFound
+		}
+		if len(b) < recordHeaderLen {
+			return "", errIncomplete
+		}
+		if b[1] != 3 {
+			return "", errNotFound
+		}
+
+		n := int(b[3])<<8 | int(b[4])
+		b = b[recordHeaderLen:]
+		if n > len(b) {
+			hello = append(hello, b...)
+			b = nil
+		} else {
+			hello = append(hello, b[:n]...)
+			b = b[n:]
+		}
+
+		if host, err := clientHello(hello); err != errIncomplete {
+			return host, err
+		}
+	}
+	return "", errNotFound
+}
+
+// clientHello sniffs the server name of the ClientHello handshake message,
+// which is carried by TLS records or QUIC CRYPTO frames.
+func clientHello(m []byte) (string, error) {
+	if len(m) < handshakeHeaderLen {
+		return "", errIncomplete
+	}
+	if m[0] != handshakeTypeClientHello {
+		return "", errNotFound
+	}
+	n := int(m[1])<<16 | int(m[2])<<8 | int(m[3])
+	if len(m) < handshakeHeaderLen+n {
+		return "", errIncomplete
+	}
+
+	r := reader(m[handshakeHeaderLen : handshakeHeaderLen+n])
+	// The legacy version and the random.
+	r.skip(2 + 32)
+	// The legacy session ID, the cipher suites and the legacy compression
+	// methods.
+	r.skip(r.uint8())
+	r.skip(r.uint16())
+	r.skip(r.uint8())
+
+	extensions := reader(r.bytes(r.uint16()))
+	for len(extensions) > 0 {
+		typ := extensions.uint16()
+		data := reader(extensions.bytes(extensions.uint16()))
+		if typ != extensionServerName {
+			continue
+		}
+
+		names := reader(data.bytes(data.uint16()))
+		for len(names) > 0 {
+			nameType := names.uint8()
+			name := names.bytes(names.uint16())
+			if nameType == serverNameTypeHostName && len(name) > 0 {
+				return domain(string(name))
+			}
+		}
+	}
+	return "", errNotFound
+}
+
+// reader reads the big-endian fields, the missing ones of which are zero.
+type reader []byte
+
+func (r *reader) bytes(n int) []byte {
+	if n < 0 || n > len(*r) {
+		n = len(*r)
+	}
+	b := (*r)[:n]
+	*r = (*r)[n:]
+	return b
+}
+
+func (r *reader) skip(n int) {
+	r.bytes(n)
+}
+
+func (r *reader) uint8() int {
+	b := r.bytes(1)
+	if len(b) < 1 {
+		return 0
+	}
+	return int(b[0])
+}
+
+func (r *reader) uint16() int {
+	b := r.bytes(2)
+	if len(b) < 2 {
+		return 0
+	}
+	return int(b[0])<<8 | int(b[1])
+}
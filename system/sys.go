@@ -3,6 +3,7 @@ package system
 import (
 	"bufio"
 	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"io"
@@ -10,6 +11,7 @@ import (
 	"net"
 	"net/http"
 	"net/url"
+	"os"
 	"sort"
 	"strconv"
 	"strings"
@@ -17,84 +19,327 @@ import (
 
 	"github.com/fanpei91/spn/dialer"
 	"github.com/fanpei91/spn/dns"
+	"github.com/fanpei91/spn/inbound"
 	"github.com/fanpei91/spn/ipdb"
 	"github.com/fanpei91/spn/proxy"
+	"github.com/fanpei91/spn/rule"
+	"github.com/fanpei91/spn/sniff"
 	"github.com/fanpei91/spn/tun"
 	"github.com/fanpei91/spn/utils"
 	"github.com/robfig/cron/v3"
 	"github.com/sirupsen/logrus"
 )
 
-const (
-	gateway = "198.18.0.1"
-	ipRange = "198.18.0.0/16"
-)
-
 var errNoSuchHost = errors.New("lookup: no such host")
 
+type Config struct {
+	NIC               string
+	UpstreamDNS       string
+	ServerAddr        string
+	User              string
+	SecretKey         string
+	DoHURL            string
+	DoHFormat         string
+	DoHMethod         string
+	StaticDoHTTL      time.Duration
+	DoTUpstream       string
+	DoTServerName     string
+	TCPUpstream       string
+	DNSOverProxy      bool
+	EnableDNSFallback bool
+	HijackDNS         bool
+	EnableMux         bool
+	RulesFile         string
+	Proxies           []string
+	FakeIPFile        string
+	DNSRoutesFile     string
+	DNSStrategy       string
+	TunName           string
+	TunAddr           string
+	TunAddr6          string
+	FakeIPRange       string
+	MTU               int
+	TunBacklog        int
+	DNSServer         string
+	EnableTun         bool
+	SOCKS5Addr        string
+	HTTPAddr          string
+	TProxyAddr        string
+	RedirectAddr      string
+	GatewayDNSAddr    string
+	DNSMode           string
+	DNSListenAddr     string
+	DoTListenAddr     string
+	DoHListenAddr     string
+	DNSCertFile       string
+	DNSKeyFile        string
+	SniffTimeout      time.Duration
+	SniffPorts        string
+}
+
 type System struct {
-	nic                string
-	upstreamDNS        string
-	staticDoHTTL       time.Duration
+	config             Config
 	tun                string
-	secretKey          string
-	serverAddr         string
+	tunAddr            *net.IPNet
+	tunAddr6           *net.IPNet
+	fakeIPRange        *net.IPNet
 	originalDNSServers []string
 	dnsHijacker        *dns.Hijacker
 	dnsResolver        dns.Handler
+	dnsStrategy        dns.Strategy
+	dnsMode            dns.Mode
+	sniffPorts         sniff.Ports
+	dnsCaches          []*dns.HandlerOverCache
 	listener           *tun.Listener
-	hijackDNS          bool
+	inbounds           []io.Closer
+	udpNAT             *udpNAT
+	rules              *rule.Engine
+	outbounds          map[string]proxy.Client
 	ipdbClient         *http.Client
 }
 
-func New(nic, upstreamDNS, secretKey, serverAddr string, staticDoHTTL time.Duration, enableDNSFallback, hijackDNS bool) (sys *System, err error) {
+func New(config Config) (sys *System, err error) {
 	sys = &System{
-		nic:          nic,
-		upstreamDNS:  upstreamDNS,
-		staticDoHTTL: staticDoHTTL,
-		secretKey:    secretKey,
-		serverAddr:   serverAddr,
-		hijackDNS:    hijackDNS,
+		config: config,
+		udpNAT: newUDPNAT(),
+	}
+
+	if config.RulesFile != "" {
+		sys.rules, err = rule.Load(config.RulesFile)
+	} else {
+		sys.rules, err = rule.NewEngine(rule.Default)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	sys.outbounds = map[string]proxy.Client{
+		rule.Direct: proxy.Direct,
+		rule.Proxy:  sys.proxyClient(),
+	}
+	for _, p := range config.Proxies {
+		name, client, err := sys.parseProxy(p)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := sys.outbounds[name]; ok || name == rule.Reject {
+			return nil, fmt.Errorf("duplicate outbound %s", name)
+		}
+		sys.outbounds[name] = client
+	}
+	for _, target := range sys.rules.Targets() {
+		if _, ok := sys.outbounds[target]; !ok && target != rule.Reject {
+			return nil, fmt.Errorf("unknown outbound %s in rules", target)
+		}
+	}
+	if err := sys.parseAddrs(); err != nil {
+		return nil, err
+	}
+
+	if sys.dnsStrategy, err = dns.ParseStrategy(config.DNSStrategy); err != nil {
+		return nil, err
+	}
+	if sys.dnsMode, err = dns.ParseMode(config.DNSMode); err != nil {
+		return nil, err
+	}
+	if sys.sniffPorts, err = sniff.ParsePorts(config.SniffPorts); err != nil {
+		return nil, err
 	}
+
 	upstreams := []dns.Handler{
 		dns.NewHandlerOverHTTPS(
-			staticDoHTTL,
-			dns.DefaultDNSOverHTTPSProvider,
-			upstreamDNS,
+			config.StaticDoHTTL,
+			config.DoHURL,
+			config.DoHFormat,
+			config.DoHMethod,
+			config.UpstreamDNS,
 			5*time.Second,
-			func(request *http.Request) (*url.URL, error) {
-				return url.Parse("https://" + serverAddr)
-			},
-			http.Header{
-				proxy.HeaderSecret: []string{secretKey},
-			},
+			sys.proxyURL,
+			sys.proxyHeader,
 		),
 	}
-	if enableDNSFallback {
+	if config.DoTUpstream != "" {
+		upstreams = append(
+			upstreams,
+			dns.NewHandlerOverTLS(config.DoTUpstream, config.DoTServerName, 5*time.Second, sys.dialDNS),
+		)
+	}
+	if config.TCPUpstream != "" {
+		upstreams = append(
+			upstreams,
+			dns.NewHandlerOverTCP(config.TCPUpstream, 5*time.Second, sys.dialDNS),
+		)
+	}
+	if config.EnableDNSFallback {
 		upstreams = append(
 			upstreams,
-			dns.NewHandlerOverUDP(upstreamDNS, time.Second),
+			dns.NewHandlerOverUDP(config.UpstreamDNS, time.Second),
 		)
 	}
 
-	sys.dnsResolver = dns.NewHandlerOverCache(upstreams)
-	sys.dnsHijacker, _ = dns.NewHijacker(ipRange)
+	sys.dnsResolver = sys.dnsCache(upstreams)
+	if config.DNSRoutesFile != "" {
+		if sys.dnsResolver, err = sys.dnsRouter(config.DNSRoutesFile, sys.dnsResolver); err != nil {
+			return nil, err
+		}
+	}
+	sys.dnsHijacker, err = dns.NewHijacker(config.FakeIPRange, sys.dnsMode, sys.dnsResolver)
+	if err != nil {
+		return nil, err
+	}
+	if config.FakeIPFile != "" {
+		if err := sys.dnsHijacker.Load(config.FakeIPFile); err != nil && !os.IsNotExist(err) {
+			logrus.Warnf("failed to load fake IPs from %s: %v", config.FakeIPFile, err)
+		}
+	}
 
 	sys.ipdbClient = utils.HTTPClient(
 		5*time.Minute,
-		func(request *http.Request) (*url.URL, error) {
-			return url.Parse("https://" + serverAddr)
-		},
-		http.Header{
-			proxy.HeaderSecret: []string{secretKey},
-		},
-		upstreamDNS,
+		sys.proxyURL,
+		sys.proxyHeader,
+		config.UpstreamDNS,
 	)
 	return sys, nil
 }
 
+// parseProxy parses a named proxy outbound of name=https://[user:key@]host[:port],
+// whose user and secret key are those of the server if not given.
+func (s *System) parseProxy(p string) (string, proxy.Client, error) {
+	i := strings.IndexByte(p, '=')
+	if i <= 0 {
+		return "", nil, fmt.Errorf("invalid proxy %q, want name=url", p)
+	}
+	name := p[:i]
+
+	u, err := url.Parse(p[i+1:])
+	if err != nil {
+		return "", nil, fmt.Errorf("invalid proxy %s: %v", name, err)
+	}
+	if u.Scheme != "https" || u.Hostname() == "" {
+		return "", nil, fmt.Errorf("invalid proxy %s: want https://[user:key@]host[:port]", name)
+	}
+
+	server := u.Host
+	if u.Port() == "" {
+		server = net.JoinHostPort(u.Hostname(), "443")
+	}
+	user, secretKey := s.config.User, s.config.SecretKey
+	if u.User != nil {
+		user = u.User.Username()
+		if key, ok := u.User.Password(); ok {
+			secretKey = key
+		}
+	}
+	return name, proxy.NewHTTPSClient(server, s.config.UpstreamDNS, user, secretKey, s.config.EnableMux), nil
+}
+
+// parseAddrs parses the addresses of the tun and the fake IP range, which may
+// share the gateway only.
+func (s *System) parseAddrs() (err error) {
+	if s.tunAddr, err = parseCIDR(s.config.TunAddr); err != nil {
+		return err
+	}
+	if s.tunAddr.IP.To4() == nil {
+		return fmt.Errorf("tun address %s isn't IPv4", s.config.TunAddr)
+	}
+
+	if s.config.TunAddr6 != "" {
+		if s.tunAddr6, err = parseCIDR(s.config.TunAddr6); err != nil {
+			return err
+		}
+		if s.tunAddr6.IP.To4() != nil {
+			return fmt.Errorf("tun address %s isn't IPv6", s.config.TunAddr6)
+		}
+	}
+
+	if _, s.fakeIPRange, err = net.ParseCIDR(s.config.FakeIPRange); err != nil {
+		return err
+	}
+	gateway := make(net.IP, len(s.fakeIPRange.IP))
+	copy(gateway, s.fakeIPRange.IP)
+	gateway[len(gateway)-1]++
+	if s.fakeIPRange.Contains(s.tunAddr.IP) && !s.tunAddr.IP.Equal(gateway) {
+		return fmt.Errorf("tun address %s must be %s or out of fake IP range %s", s.tunAddr.IP, gateway, s.fakeIPRange)
+	}
+	return nil
+}
+
+func parseCIDR(s string) (*net.IPNet, error) {
+	ip, ipNet, err := net.ParseCIDR(s)
+	if err != nil {
+		return nil, err
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	return &net.IPNet{IP: ip, Mask: ipNet.Mask}, nil
+}
+
+// checkOverlaps makes sure that the addresses of the tun and the fake IPs
+// don't take those of the existing networks.
+func (s *System) checkOverlaps() error {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return err
+	}
+
+	for _, iface := range ifaces {
+		if iface.Name == s.config.TunName {
+			continue
+		}
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			ipNet, ok := addr.(*net.IPNet)
+			if !ok {
+				continue
+			}
+			for _, own := range []*net.IPNet{s.tunAddr, s.tunAddr6, s.fakeIPRange} {
+				if own != nil && (own.Contains(ipNet.IP) || ipNet.Contains(own.IP)) {
+					return fmt.Errorf("%s overlaps with %s of %s", own, ipNet, iface.Name)
+				}
+			}
+		}
+	}
+	return nil
+}
+
 func (s *System) Setup() error {
-	ns, err := getDNSServers(s.nic)
+	if !s.config.EnableTun && !s.hasInbounds() {
+		return errors.New("neither tun nor inbounds are enabled")
+	}
+
+	if s.config.EnableTun {
+		if err := s.setupTun(); err != nil {
+			return err
+		}
+	}
+
+	if err := s.listenInbounds(); err != nil {
+		return err
+	}
+
+	c := cron.New()
+	c.AddFunc("@every 4h", s.pullLatestIPdb)
+	c.AddFunc("@every 1m", s.saveFakeIPs)
+	c.AddFunc("@every 1h", s.logFakeIPStats)
+	c.AddFunc("@every 1h", s.logDNSStats)
+	if s.config.EnableTun {
+		c.AddFunc("@every 1h", s.logTunStats)
+	}
+	c.Start()
+
+	return nil
+}
+
+func (s *System) setupTun() error {
+	if err := s.checkOverlaps(); err != nil {
+		return err
+	}
+
+	ns, err := getDNSServers(s.config.NIC)
 	if err != nil {
 		return err
 	}
@@ -106,36 +351,180 @@ func (s *System) Setup() error {
 		return err
 	}
 
-	if err := upTunIface(s.listener.Iface()); err != nil {
+	s.tun = s.listener.Iface()
+
+	if err := upTunIface(s.tun, s.tunAddr, s.tunAddr6); err != nil {
 		return err
 	}
 
-	if err := setDNSServers([]string{"1.1.1.1"}, s.nic); err != nil {
+	if err := setDNSServers([]string{s.config.DNSServer}, s.config.NIC); err != nil {
 		return err
 	}
 
-	if err := setSysRoute(); err != nil {
-		return err
+	return setSysRoute(s.tun, s.tunAddr.IP, s.tunAddr6 != nil)
+}
+
+func (s *System) hasInbounds() bool {
+	c := s.config
+	return c.SOCKS5Addr != "" || c.HTTPAddr != "" || c.TProxyAddr != "" || c.RedirectAddr != "" || c.GatewayDNSAddr != "" ||
+		c.DNSListenAddr != "" || c.DoTListenAddr != "" || c.DoHListenAddr != ""
+}
+
+// listenInbounds listens on the addresses of the inbounds, if any, whose
+// connections are routed as those of the tun.
+func (s *System) listenInbounds() error {
+	if s.config.SOCKS5Addr != "" {
+		socks, err := inbound.ListenSOCKS5(s.config.SOCKS5Addr, s)
+		if err != nil {
+			return err
+		}
+		s.inbounds = append(s.inbounds, socks)
+		logrus.Infof("SOCKS5 inbound listening on %s", socks.Addr())
 	}
 
-	c := cron.New()
-	c.AddFunc("@every 4h", s.pullLatestIPdb)
-	c.Start()
+	if s.config.HTTPAddr != "" {
+		h, err := inbound.ListenHTTP(s.config.HTTPAddr, s)
+		if err != nil {
+			return err
+		}
+		s.inbounds = append(s.inbounds, h)
+		logrus.Infof("HTTP inbound listening on %s", h.Addr())
+	}
+
+	if s.config.TProxyAddr != "" {
+		tp, err := inbound.ListenTProxy(s.config.TProxyAddr, gateway{s})
+		if err != nil {
+			return err
+		}
+		s.inbounds = append(s.inbounds, tp)
+		logrus.Infof("TPROXY inbound listening on %s", tp.Addr())
+	}
 
+	if s.config.RedirectAddr != "" {
+		r, err := inbound.ListenRedirect(s.config.RedirectAddr, gateway{s})
+		if err != nil {
+			return err
+		}
+		s.inbounds = append(s.inbounds, r)
+		logrus.Infof("REDIRECT inbound listening on %s", r.Addr())
+	}
+
+	if s.config.GatewayDNSAddr != "" {
+		d, err := dns.ListenAndServe(s.config.GatewayDNSAddr, s.dnsHijacker)
+		if err != nil {
+			return err
+		}
+		s.inbounds = append(s.inbounds, d)
+		logrus.Infof("gateway DNS listening on %s", d.Addr())
+	}
+
+	return s.listenDNS()
+}
+
+// listenDNS serves the DNS of the mode for the other machines over UDP and
+// TCP, TLS, or HTTPS, which is HTTP without the certificate.
+func (s *System) listenDNS() error {
+	var tlsConfig *tls.Config
+	if s.config.DNSCertFile != "" || s.config.DNSKeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(s.config.DNSCertFile, s.config.DNSKeyFile)
+		if err != nil {
+			return err
+		}
+		tlsConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+	}
+
+	if s.config.DNSListenAddr != "" {
+		d, err := dns.ListenAndServe(s.config.DNSListenAddr, s.dnsHijacker)
+		if err != nil {
+			return err
+		}
+		s.inbounds = append(s.inbounds, d)
+		logrus.Infof("DNS of %s listening on %s", s.dnsMode, d.Addr())
+	}
+
+	if s.config.DoTListenAddr != "" {
+		if tlsConfig == nil {
+			return errors.New("DoT listener needs the certificate and the private key")
+		}
+		d, err := dns.ListenAndServeTLS(s.config.DoTListenAddr, tlsConfig, s.dnsHijacker)
+		if err != nil {
+			return err
+		}
+		s.inbounds = append(s.inbounds, d)
+		logrus.Infof("DoT of %s listening on %s", s.dnsMode, d.Addr())
+	}
+
+	if s.config.DoHListenAddr != "" {
+		d, err := dns.ListenAndServeHTTPS(s.config.DoHListenAddr, tlsConfig, s.dnsHijacker)
+		if err != nil {
+			return err
+		}
+		s.inbounds = append(s.inbounds, d)
+		logrus.Infof("DoH of %s listening on %s", s.dnsMode, d.Addr())
+	}
 	return nil
 }
 
 func (s *System) Destroy() error {
-	resetSysRoute()
+	if s.config.EnableTun {
+		resetSysRoute(s.tun, s.tunAddr.IP, s.tunAddr6 != nil)
+	}
 	if s.listener != nil {
 		s.listener.Close()
 	}
-	setDNSServers(s.originalDNSServers, s.nic)
+	for _, in := range s.inbounds {
+		in.Close()
+	}
+	if s.originalDNSServers != nil {
+		setDNSServers(s.originalDNSServers, s.config.NIC)
+	}
+	s.saveFakeIPs()
 	return nil
 }
 
+func (s *System) logFakeIPStats() {
+	stats := s.dnsHijacker.Stats()
+	logrus.Infof(
+		"fake IP pool: %d/%d used, %d pinned, %d evictions, %d collisions",
+		stats.Size,
+		stats.Capacity,
+		stats.Pinned,
+		stats.Evictions,
+		stats.Collisions,
+	)
+}
+
+func (s *System) logTunStats() {
+	stats := s.listener.Stats()
+	logrus.Infof("tun: %d TCP and %d UDP connections dropped", stats.TCPDrops, stats.UDPDrops)
+}
+
+func (s *System) logDNSStats() {
+	for _, stats := range s.DNSStats() {
+		logrus.Infof("DNS upstream %s", stats)
+	}
+}
+
+// DNSStats tells how each of the DNS upstreams has done.
+func (s *System) DNSStats() []dns.UpstreamStats {
+	var stats []dns.UpstreamStats
+	for _, cache := range s.dnsCaches {
+		stats = append(stats, cache.Stats()...)
+	}
+	return stats
+}
+
+func (s *System) saveFakeIPs() {
+	if s.config.FakeIPFile == "" {
+		return
+	}
+	if err := s.dnsHijacker.Save(s.config.FakeIPFile); err != nil {
+		logrus.Warnf("failed to save fake IPs to %s: %v", s.config.FakeIPFile, err)
+	}
+}
+
 func (s *System) listenTun() (err error) {
-	if s.listener, err = tun.Listen(1500); err != nil {
+	if s.listener, err = tun.Listen(s.config.TunName, s.config.MTU, s.config.TunBacklog); err != nil {
 		return err
 	}
 
@@ -146,9 +535,9 @@ func (s *System) listenTun() (err error) {
 }
 
 func (s *System) acceptUDP() {
-	var con net.Conn
 	for {
-		if con = s.listener.AcceptUDP(); con == nil {
+		con, err := s.listener.AcceptUDP()
+		if err != nil {
 			break
 		}
 		go s.handleUDP(con)
@@ -156,9 +545,9 @@ func (s *System) acceptUDP() {
 }
 
 func (s *System) acceptTCP() {
-	var con net.Conn
 	for {
-		if con = s.listener.AcceptTCP(); con == nil {
+		con, err := s.listener.AcceptTCP()
+		if err != nil {
 			break
 		}
 		go s.handleTCP(con)
@@ -166,56 +555,147 @@ func (s *System) acceptTCP() {
 }
 
 func (s *System) handleTCP(tunConn net.Conn) {
-	conn, domain, err := s.outboundConn(tunConn)
-	if err != nil && err == errNoSuchHost {
-		s.handleNoSuchHostConn(tunConn, domain)
-		return
+	var ok bool
+	if s.config.HijackDNS {
+		if tunConn, ok = s.dnsHijacker.TryHijack(tunConn); ok {
+			return
+		}
 	}
 
-	s.handleConn(conn, domain, nil)
+	s.serve(tunConn, "", nil)
 }
 
 func (s *System) handleUDP(tunConn net.Conn) {
+	defer s.udpNAT.writeFrom(tunConn, tunConn.LocalAddr().String())()
+
 	var ok bool
-	if s.hijackDNS {
+	if s.config.HijackDNS {
 		if tunConn, ok = s.dnsHijacker.TryHijack(tunConn); ok {
 			return
 		}
 	}
 
-	conn, domain, err := s.outboundConn(tunConn)
-	if err != nil && err == errNoSuchHost {
-		s.handleNoSuchHostConn(tunConn, domain)
+	s.serve(tunConn, "", setUDPReadDeadline)
+}
+
+// HandleTCP routes the connection of the inbounds to the target, as those of
+// the tun are.
+func (s *System) HandleTCP(conn net.Conn, target string) {
+	s.handleInbound(conn, "tcp", target, false, nil)
+}
+
+// HandleUDP routes the datagrams of the inbounds to the target, as those of
+// the tun are.
+func (s *System) HandleUDP(conn net.Conn, target string) {
+	s.handleInbound(conn, "udp", target, false, setUDPReadDeadline)
+}
+
+// gateway handles the connections of the LAN devices diverted to the gateway
+// inbounds, whose DNS queries are hijacked as those of the tun.
+type gateway struct {
+	*System
+}
+
+func (g gateway) HandleTCP(conn net.Conn, target string) {
+	g.handleInbound(conn, "tcp", target, true, nil)
+}
+
+func (g gateway) HandleUDP(conn net.Conn, target string) {
+	g.handleInbound(conn, "udp", target, true, setUDPReadDeadline)
+}
+
+// handleInbound makes the connection of the inbounds look like that of the
+// tun, which comes from the client and goes to the target. A target of a
+// domain goes to its addresses, just as its fake IP does.
+func (s *System) handleInbound(conn net.Conn, network, target string, hijack bool, setReadDeadline func(conn net.Conn)) {
+	host, port, err := net.SplitHostPort(target)
+	if err != nil {
+		logrus.Warnf("%s invalid target %s://%s: %v", conn.RemoteAddr(), network, target, err)
+		conn.Close()
 		return
 	}
+	p, _ := strconv.Atoi(port)
+	ip := net.ParseIP(host)
+
+	if network == "udp" {
+		defer s.udpNAT.writeFrom(conn, conn.RemoteAddr().String())()
+	}
 
-	s.handleConn(
-		conn,
-		domain,
-		func(conn net.Conn) {
-			conn.SetReadDeadline(
-				time.Now().Add(proxy.UDPReadTimeout),
-			)
+	conn = dialer.Conn{
+		Conn:  conn,
+		Local: conn.RemoteAddr(),
+		Remote: dialer.Addr{
+			IP:   ip,
+			Port: p,
+			Net:  network,
 		},
+	}
+
+	if hijack && s.config.HijackDNS {
+		var ok bool
+		if conn, ok = s.dnsHijacker.TryHijack(conn); ok {
+			return
+		}
+	}
+
+	var domain string
+	if ip == nil {
+		domain = strings.TrimSuffix(host, ".")
+	}
+	s.serve(conn, domain, setReadDeadline)
+}
+
+// serve routes the connection to the addresses of the domain, or to its
+// target if the domain is empty, which is a fake IP of a domain or not.
+func (s *System) serve(conn net.Conn, domain string, setReadDeadline func(conn net.Conn)) {
+	var outConn net.Conn
+	var err error
+	if domain == "" {
+		defer s.pinFakeIP(conn)()
+		outConn, domain, err = s.outboundConn(conn)
+	} else {
+		outConn, err = s.resolveConn(conn, domain)
+	}
+
+	if err != nil && err == errNoSuchHost {
+		s.handleNoSuchHostConn(conn, domain)
+		return
+	}
+
+	s.handleConn(outConn, domain, setReadDeadline)
+}
+
+func setUDPReadDeadline(conn net.Conn) {
+	conn.SetReadDeadline(
+		time.Now().Add(proxy.UDPReadTimeout),
 	)
 }
 
+// The domain of the connection can't be resolved locally, so it is only
+// reachable through a proxy which resolves it on the other side.
 func (s *System) handleNoSuchHostConn(conn net.Conn, domain string) {
-	client := proxy.NewHTTPSClient(
-		s.serverAddr,
-		s.upstreamDNS,
-		http.Header{
-			proxy.HeaderSecret: []string{s.secretKey},
-		},
-	)
 	network := conn.RemoteAddr().Network()
 
 	_, port, _ := net.SplitHostPort(conn.RemoteAddr().String())
 	addr := net.JoinHostPort(domain, port)
 
-	logrus.Infof("%s dial %s://%s via proxy %s", conn.LocalAddr(), network, addr, client.String())
+	client, r := s.route(network, domain, nil, port)
+	hostClient, ok := client.(proxy.HostClient)
+	if !ok {
+		logrus.Warnf("%s reject %s://%s by rule %s: no such host", conn.LocalAddr(), network, addr, r)
+		conn.Close()
+		return
+	}
 
-	targetConn, err := client.DialHost(context.Background(), network, addr)
+	if packetClient, ok := client.(proxy.PacketClient); ok && network == "udp" {
+		logrus.Infof("%s relay %s://%s via proxy %s by rule %s", conn.LocalAddr(), network, addr, client.String(), r)
+		s.udpNAT.relay(packetClient, conn, addr)
+		return
+	}
+
+	logrus.Infof("%s dial %s://%s via proxy %s by rule %s", conn.LocalAddr(), network, addr, client.String(), r)
+
+	targetConn, err := hostClient.DialHost(context.Background(), network, addr)
 	if err != nil {
 		logrus.Warnf(
 			"%s faield to dial %s://%s via proxy %s: %v",
@@ -237,21 +717,11 @@ func (s *System) handleNoSuchHostConn(conn net.Conn, domain string) {
 
 func (s *System) handleConn(conn net.Conn, domain string, setReadDeadline func(conn net.Conn)) {
 	targetAddr := conn.RemoteAddr().String()
-	targetHost, _, _ := net.SplitHostPort(targetAddr)
+	targetHost, targetPort, _ := net.SplitHostPort(targetAddr)
 	targetIP := net.ParseIP(targetHost)
 	network := conn.RemoteAddr().Network()
 
-	var client = proxy.Direct
-
-	if !ipdb.China.Contains(targetIP) && !ipdb.Private.Contains(targetIP) {
-		client = proxy.HTTPS(
-			s.serverAddr,
-			s.upstreamDNS,
-			http.Header{
-				proxy.HeaderSecret: []string{s.secretKey},
-			},
-		)
-	}
+	client, r := s.route(network, domain, targetIP, targetPort)
 
 	var targetConn net.Conn
 	var err error
@@ -260,9 +730,21 @@ func (s *System) handleConn(conn net.Conn, domain string, setReadDeadline func(c
 		domain = fmt.Sprintf("[%s]", domain)
 	}
 
-	logrus.Infof("%s dial %s://%s%s via proxy %s", conn.LocalAddr(), conn.RemoteAddr().Network(), conn.RemoteAddr(), domain, client.String())
+	if client == nil {
+		logrus.Infof("%s reject %s://%s%s by rule %s", conn.LocalAddr(), network, conn.RemoteAddr(), domain, r)
+		conn.Close()
+		return
+	}
+
+	if packetClient, ok := client.(proxy.PacketClient); ok && network == "udp" {
+		logrus.Infof("%s relay %s://%s%s via proxy %s by rule %s", conn.LocalAddr(), network, conn.RemoteAddr(), domain, client.String(), r)
+		s.udpNAT.relay(packetClient, conn, proxyAddr(conn, targetAddr))
+		return
+	}
+
+	logrus.Infof("%s dial %s://%s%s via proxy %s by rule %s", conn.LocalAddr(), conn.RemoteAddr().Network(), conn.RemoteAddr(), domain, client.String(), r)
 
-	if targetConn, err = client.Dial(context.Background(), network, targetAddr); err != nil {
+	if targetConn, err = dial(client, conn, network, targetAddr); err != nil {
 		logrus.Warnf(
 			"%s faield to dial %s://%s%s via proxy %s: %v",
 			conn.LocalAddr(),
@@ -285,23 +767,203 @@ func (s *System) handleConn(conn net.Conn, domain string, setReadDeadline func(c
 	utils.Exchange(targetConn, conn)
 }
 
+// route returns the outbound of the rule the connection matches, which is nil
+// for a rejected connection.
+func (s *System) route(network, domain string, ip net.IP, port string) (proxy.Client, *rule.Rule) {
+	p, _ := strconv.Atoi(port)
+	r := s.rules.Match(&rule.Metadata{
+		Network: network,
+		Host:    domain,
+		IP:      ip,
+		Port:    p,
+	})
+	return s.outbounds[r.Target], r
+}
+
+// dial connects to the target of the connection, or to any of the addresses
+// of its domain when the client can.
+func dial(client proxy.Client, conn net.Conn, network, targetAddr string) (net.Conn, error) {
+	if hostClient, ok := client.(proxy.HostClient); ok {
+		if addr := proxyAddr(conn, targetAddr); addr != targetAddr {
+			return hostClient.DialHost(context.Background(), network, addr)
+		}
+	}
+	if out, ok := conn.(outboundConn); ok && len(out.dstAddrs) > 1 {
+		if addrsClient, ok := client.(proxy.AddrsClient); ok {
+			return addrsClient.DialAddrs(context.Background(), network, out.dstAddrs, strconv.Itoa(out.dstPort))
+		}
+	}
+	return client.Dial(context.Background(), network, targetAddr)
+}
+
+// proxyAddr is the target of the connection for the proxy, which is of the
+// sniffed domain so that the other side resolves it.
+func proxyAddr(conn net.Conn, targetAddr string) string {
+	if sniffed, ok := conn.(sniffedConn); ok {
+		_, port, _ := net.SplitHostPort(targetAddr)
+		return net.JoinHostPort(sniffed.host, port)
+	}
+	return targetAddr
+}
+
+// pinFakeIP keeps the fake IP the connection goes to for its domain while
+// it is open.
+func (s *System) pinFakeIP(conn net.Conn) (release func()) {
+	host, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+	return s.dnsHijacker.Pin(net.ParseIP(host))
+}
+
 func (s *System) outboundConn(conn net.Conn) (outConn net.Conn, domain string, err error) {
-	host, port, _ := net.SplitHostPort(conn.RemoteAddr().String())
+	host, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
 	ip := net.ParseIP(host)
 
 	host, ok := s.dnsHijacker.ReverseLookup(ip)
 	if !ok {
-		return conn, "", nil
+		// The real IPs are routed by the domain sniffed from the
+		// connection, or by the one they were answered for.
+		if conn, host = s.sniff(conn); host != "" {
+			return conn, host, nil
+		}
+		host, _ = s.dnsHijacker.Domain(ip)
+		return conn, host, nil
 	}
 
-	addr, _ := s.dnsResolver.Lookup(host)
-	if addr == nil {
-		return conn, host, errNoSuchHost
+	outConn, err = s.resolveConn(conn, host)
+	return outConn, host, err
+}
+
+// sniff recovers the domain of the connection to one of the ports sniffed
+// from its first bytes. The connection is routed by the domain then, and
+// the proxy is asked for the domain instead of the real IP.
+func (s *System) sniff(conn net.Conn) (net.Conn, string) {
+	if s.config.SniffTimeout <= 0 {
+		return conn, ""
+	}
+	_, port, _ := net.SplitHostPort(conn.RemoteAddr().String())
+	p, _ := strconv.Atoi(port)
+	if !s.sniffPorts.Contains(conn.RemoteAddr().Network(), p) {
+		return conn, ""
 	}
 
+	conn, host := sniff.Conn(conn, s.config.SniffTimeout)
+	if host == "" {
+		return conn, ""
+	}
+	logrus.Debugf("%s sniffed %s://%s[%s]", conn.LocalAddr(), conn.RemoteAddr().Network(), conn.RemoteAddr(), host)
+	return sniffedConn{Conn: conn, host: host}, host
+}
+
+// resolveConn makes the connection go to the addresses of the domain.
+func (s *System) resolveConn(conn net.Conn, domain string) (net.Conn, error) {
+	addrs, _ := s.dnsResolver.Lookup(domain)
+	if len(addrs) == 0 {
+		return conn, errNoSuchHost
+	}
+
+	_, port, _ := net.SplitHostPort(conn.RemoteAddr().String())
 	p, _ := strconv.ParseInt(port, 10, 32)
 
-	return outboundConn{Conn: conn, dstAddr: addr, dstPort: int(p)}, host, nil
+	return outboundConn{Conn: conn, dstAddrs: addrs, dstPort: int(p)}, nil
+}
+
+func (s *System) proxyClient() *proxy.HTTPSClient {
+	return proxy.NewHTTPSClient(
+		s.config.ServerAddr,
+		s.config.UpstreamDNS,
+		s.config.User,
+		s.config.SecretKey,
+		s.config.EnableMux,
+	)
+}
+
+func (s *System) proxyURL(*http.Request) (*url.URL, error) {
+	return url.Parse("https://" + s.config.ServerAddr)
+}
+
+func (s *System) proxyHeader(target string) http.Header {
+	return proxy.AuthHeader(s.config.User, s.config.SecretKey, target)
+}
+
+func (s *System) dnsCache(upstreams []dns.Handler) *dns.HandlerOverCache {
+	cache := dns.NewHandlerOverCache(upstreams, s.dnsStrategy)
+	s.dnsCaches = append(s.dnsCaches, cache)
+	return cache
+}
+
+// dnsRouter routes the queries to the upstreams of the routes file, each
+// with its own cache, or to the fallback.
+func (s *System) dnsRouter(path string, fallback dns.Handler) (dns.Handler, error) {
+	upstreams, err := dns.LoadRoutes(path)
+	if err != nil {
+		return nil, err
+	}
+
+	routes := make(map[string]dns.Handler, len(upstreams))
+	handlers := make(map[string]dns.Handler)
+	for suffix, upstream := range upstreams {
+		handler, ok := handlers[upstream]
+		if !ok {
+			if handler, err = s.dnsUpstream(upstream); err != nil {
+				return nil, err
+			}
+			handler = s.dnsCache([]dns.Handler{handler})
+			handlers[upstream] = handler
+		}
+		routes[suffix] = handler
+	}
+
+	return dns.NewHandlerOverRouter(routes, fallback), nil
+}
+
+// dnsUpstream makes the handler of a route upstream. DoH goes through the
+// server, the others go directly, as the upstreams of the routes are
+// usually local ones.
+func (s *System) dnsUpstream(upstream string) (dns.Handler, error) {
+	switch {
+	case strings.HasPrefix(upstream, "https://"):
+		return dns.NewHandlerOverHTTPS(
+			s.config.StaticDoHTTL,
+			upstream,
+			dns.FormatWire,
+			http.MethodGet,
+			s.config.UpstreamDNS,
+			5*time.Second,
+			s.proxyURL,
+			s.proxyHeader,
+		), nil
+	case strings.HasPrefix(upstream, "tls://"):
+		addr := strings.TrimPrefix(upstream, "tls://")
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			addr = net.JoinHostPort(addr, "853")
+		}
+		return dns.NewHandlerOverTLS(addr, "", 5*time.Second, s.dialDirect), nil
+	case strings.HasPrefix(upstream, "tcp://"):
+		addr := dns.ParseUpstream(strings.TrimPrefix(upstream, "tcp://"))
+		return dns.NewHandlerOverTCP(addr, 5*time.Second, s.dialDirect), nil
+	case strings.Contains(upstream, "://") && !strings.HasPrefix(upstream, "udp://"):
+		return nil, fmt.Errorf("unknown DNS upstream %s", upstream)
+	}
+
+	addr := dns.ParseUpstream(strings.TrimPrefix(upstream, "udp://"))
+	return dns.NewHandlerOverUDP(addr, time.Second), nil
+}
+
+// dialDNS connects to the DNS upstreams through the server, or directly.
+func (s *System) dialDNS(ctx context.Context, network, addr string) (net.Conn, error) {
+	if s.config.DNSOverProxy {
+		return s.proxyClient().DialHost(ctx, network, addr)
+	}
+	return s.dialDirect(ctx, network, addr)
+}
+
+// dialDirect connects with the upstream DNS resolving the names, which must
+// not be hijacked.
+func (s *System) dialDirect(ctx context.Context, network, addr string) (net.Conn, error) {
+	d, err := dialer.NewWithResolver(s.config.UpstreamDNS)
+	if err != nil {
+		return nil, err
+	}
+	return d.DialContext(ctx, network, addr)
 }
 
 func (s *System) pullLatestIPdb() {
@@ -376,15 +1038,16 @@ func (s *System) pullLatestIPdb() {
 	return
 }
 
+// outboundConn goes to the first of the addresses of its domain.
 type outboundConn struct {
 	net.Conn
-	dstAddr net.IP
-	dstPort int
+	dstAddrs []net.IP
+	dstPort  int
 }
 
 func (r outboundConn) RemoteAddr() net.Addr {
 	return dialer.Addr{
-		IP:   r.dstAddr,
+		IP:   r.dstAddrs[0],
 		Port: r.dstPort,
 		Net:  r.Conn.RemoteAddr().Network(),
 	}
@@ -393,3 +1056,9 @@ func (r outboundConn) RemoteAddr() net.Addr {
 func (r outboundConn) LocalAddr() net.Addr {
 	return r.Conn.LocalAddr()
 }
+
+// sniffedConn goes to a real IP of the sniffed domain.
+type sniffedConn struct {
+	net.Conn
+	host string
+}
@@ -4,7 +4,9 @@ package system
 
 import (
 	"errors"
+	"net"
 	"os/exec"
+	"strconv"
 	"strings"
 
 	"github.com/sirupsen/logrus"
@@ -21,41 +23,53 @@ var routeNets = []string{
 	"128.0/1",
 }
 
-func setSysRoute() error {
-	for _, net := range routeNets {
-		c := exec.Command("route", "add", "-net", net, gateway)
-
-		logrus.Infoln(c.String())
+var routeNets6 = []string{
+	"::/1",
+	"8000::/1",
+}
 
-		if out, err := c.CombinedOutput(); err != nil {
-			return errors.New(string(out) + err.Error())
+func setSysRoute(iface string, gateway net.IP, ipv6 bool) error {
+	for _, net := range routeNets {
+		if err := run("route", "add", "-net", net, gateway.String()); err != nil {
+			return err
+		}
+	}
+	if ipv6 {
+		for _, net := range routeNets6 {
+			if err := run("route", "add", "-inet6", "-net", net, "-interface", iface); err != nil {
+				return err
+			}
 		}
 	}
 	return nil
 }
 
-func resetSysRoute() error {
+func resetSysRoute(iface string, gateway net.IP, ipv6 bool) error {
 	for _, net := range routeNets {
-		c := exec.Command("route", "delete", "-net", net, gateway)
-
-		logrus.Infoln(c.String())
-
-		if out, err := c.CombinedOutput(); err != nil {
-			return errors.New(string(out) + err.Error())
+		if err := run("route", "delete", "-net", net, gateway.String()); err != nil {
+			return err
+		}
+	}
+	if ipv6 {
+		for _, net := range routeNets6 {
+			if err := run("route", "delete", "-inet6", "-net", net, "-interface", iface); err != nil {
+				return err
+			}
 		}
 	}
 	return nil
 }
 
-func upTunIface(iface string) error {
-	c := exec.Command("ifconfig", iface, gateway, "netmask", "255.255.0.0", gateway, "up")
-
-	logrus.Infoln(c.String())
-
-	if out, err := c.CombinedOutput(); err != nil {
-		return errors.New(string(out) + err.Error())
+func upTunIface(iface string, addr, addr6 *net.IPNet) error {
+	ip := addr.IP.String()
+	if err := run("ifconfig", iface, ip, "netmask", net.IP(addr.Mask).String(), ip, "up"); err != nil {
+		return err
 	}
-	return nil
+	if addr6 == nil {
+		return nil
+	}
+	ones, _ := addr6.Mask.Size()
+	return run("ifconfig", iface, "inet6", addr6.IP.String(), "prefixlen", strconv.Itoa(ones))
 }
 
 func getDNSServers(nic string) ([]string, error) {
@@ -79,7 +93,11 @@ func setDNSServers(servers []string, nic string) error {
 	} else {
 		servers = []string{"-setdnsservers", nic, "empty"}
 	}
-	c := exec.Command("networksetup", servers...)
+	return run("networksetup", servers...)
+}
+
+func run(name string, args ...string) error {
+	c := exec.Command(name, args...)
 
 	logrus.Infoln(c.String())
 
@@ -0,0 +1,217 @@
+// +build linux
+
+package system
+
+import (
+	"errors"
+	"io/ioutil"
+	"net"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	"github.com/fanpei91/spn/dialer"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	resolvConf    = "/etc/resolv.conf"
+	resolvedStub  = "127.0.0.53"
+	routeTable    = "5357"
+	rulePriority  = 5357
+	maxStaleRules = 16
+)
+
+// Everything not marked by the dialer is routed to the tun through a
+// dedicated table, while the more specific routes of the main table, such as
+// the LAN, still win thanks to suppress_prefixlength.
+func setSysRoute(iface string, gateway net.IP, ipv6 bool) error {
+	for _, family := range families(ipv6) {
+		deleteRules(family, rulePriority)
+		deleteRules(family, rulePriority+1)
+
+		cmds := [][]string{
+			{"ip", family, "route", "replace", "default", "dev", iface, "table", routeTable},
+			{"ip", family, "rule", "add", "table", "main", "suppress_prefixlength", "0", "priority", strconv.Itoa(rulePriority)},
+			{"ip", family, "rule", "add", "not", "fwmark", strconv.Itoa(dialer.FwMark), "table", routeTable, "priority", strconv.Itoa(rulePriority + 1)},
+		}
+		for _, cmd := range cmds {
+			if err := run(cmd[0], cmd[1:]...); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func resetSysRoute(iface string, gateway net.IP, ipv6 bool) error {
+	var lastErr error
+	for _, family := range families(ipv6) {
+		cmds := [][]string{
+			{"ip", family, "rule", "delete", "priority", strconv.Itoa(rulePriority + 1)},
+			{"ip", family, "rule", "delete", "priority", strconv.Itoa(rulePriority)},
+			{"ip", family, "route", "flush", "table", routeTable},
+		}
+		for _, cmd := range cmds {
+			if err := run(cmd[0], cmd[1:]...); err != nil {
+				lastErr = err
+			}
+		}
+	}
+	return lastErr
+}
+
+// deleteRules deletes the rules of the priority, which are left behind by a
+// crashed run, as ip rule add doesn't replace them.
+func deleteRules(family string, priority int) {
+	for i := 0; i < maxStaleRules; i++ {
+		if err := run("ip", family, "rule", "delete", "priority", strconv.Itoa(priority)); err != nil {
+			return
+		}
+	}
+}
+
+func families(ipv6 bool) []string {
+	if ipv6 {
+		return []string{"-4", "-6"}
+	}
+	return []string{"-4"}
+}
+
+func upTunIface(iface string, addr, addr6 *net.IPNet) error {
+	if err := run("ip", "addr", "replace", addr.String(), "dev", iface); err != nil {
+		return err
+	}
+	if addr6 != nil {
+		if err := run("ip", "-6", "addr", "replace", addr6.String(), "dev", iface); err != nil {
+			return err
+		}
+	}
+	return run("ip", "link", "set", "dev", iface, "up")
+}
+
+func getDNSServers(nic string) ([]string, error) {
+	if useResolved() {
+		nic, err := resolvedLink(nic)
+		if err != nil {
+			return nil, err
+		}
+		c := exec.Command("resolvectl", "dns", nic)
+
+		logrus.Infoln(c.String())
+
+		out, err := c.CombinedOutput()
+		if err != nil {
+			return nil, errors.New(string(out) + err.Error())
+		}
+
+		// Link 2 (eth0): 192.168.1.1 192.168.1.2
+		parts := strings.SplitN(strings.TrimSpace(string(out)), ":", 2)
+		if len(parts) != 2 {
+			return []string{}, nil
+		}
+		return strings.Fields(parts[1]), nil
+	}
+
+	conf, err := ioutil.ReadFile(resolvConf)
+	if err != nil {
+		return nil, err
+	}
+
+	servers := []string{}
+	for _, line := range strings.Split(string(conf), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) >= 2 && fields[0] == "nameserver" {
+			servers = append(servers, fields[1])
+		}
+	}
+	return servers, nil
+}
+
+func setDNSServers(servers []string, nic string) error {
+	if useResolved() {
+		nic, err := resolvedLink(nic)
+		if err != nil {
+			return err
+		}
+		if len(servers) == 0 {
+			return run("resolvectl", "revert", nic)
+		}
+		return run("resolvectl", append([]string{"dns", nic}, servers...)...)
+	}
+
+	conf, err := ioutil.ReadFile(resolvConf)
+	if err != nil {
+		return err
+	}
+
+	var lines []string
+	replaced := false
+	for _, line := range strings.Split(strings.TrimRight(string(conf), "\n"), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) >= 1 && fields[0] == "nameserver" {
+			if !replaced {
+				for _, server := range servers {
+					lines = append(lines, "nameserver "+server)
+				}
+				replaced = true
+			}
+			continue
+		}
+		lines = append(lines, line)
+	}
+	if !replaced {
+		for _, server := range servers {
+			lines = append(lines, "nameserver "+server)
+		}
+	}
+
+	logrus.Infof("write nameservers %s to %s", servers, resolvConf)
+
+	return ioutil.WriteFile(resolvConf, []byte(strings.Join(lines, "\n")+"\n"), 0644)
+}
+
+// systemd-resolved owns resolv.conf when it points to the local stub, so the
+// upstreams of the link have to be changed through resolvectl instead.
+func useResolved() bool {
+	if _, err := exec.LookPath("resolvectl"); err != nil {
+		return false
+	}
+
+	conf, err := ioutil.ReadFile(resolvConf)
+	if err != nil {
+		return false
+	}
+	return strings.Contains(string(conf), resolvedStub)
+}
+
+// resolvedLink is the nic, or the link of the default route if it is empty.
+func resolvedLink(nic string) (string, error) {
+	if nic != "" {
+		return nic, nil
+	}
+
+	out, err := exec.Command("ip", "-4", "route", "show", "default").Output()
+	if err != nil {
+		return "", err
+	}
+	// default via 192.168.1.1 dev eth0 proto dhcp metric 100
+	fields := strings.Fields(string(out))
+	for i := 0; i+1 < len(fields); i++ {
+		if fields[i] == "dev" {
+			return fields[i+1], nil
+		}
+	}
+	return "", errors.New("no default route to set DNS on")
+}
+
+func run(name string, args ...string) error {
+	c := exec.Command(name, args...)
+
+	logrus.Infoln(c.String())
+
+	if out, err := c.CombinedOutput(); err != nil {
+		return errors.New(string(out) + err.Error())
+	}
+	return nil
+}
@@ -1,20 +1,23 @@
-// +build !darwin
+// +build !darwin,!linux
 
 package system
 
-import "errors"
+import (
+	"errors"
+	"net"
+)
 
 var errNotSupported = errors.New("not supported")
 
-func setSysRoute() error {
+func setSysRoute(iface string, gateway net.IP, ipv6 bool) error {
 	return errNotSupported
 }
 
-func resetSysRoute() error {
+func resetSysRoute(iface string, gateway net.IP, ipv6 bool) error {
 	return errNotSupported
 }
 
-func upTunIface(iface string) error {
+func upTunIface(iface string, addr, addr6 *net.IPNet) error {
 	return errNotSupported
 }
 
@@ -0,0 +1,191 @@
+package system
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/Dreamacro/clash/common/pool"
+	"github.com/fanpei91/spn/proxy"
+	"github.com/sirupsen/logrus"
+)
+
+const maxDatagramSize = 64 * 1024
+
+// udpNAT keeps one relayed association per local source address, every flow
+// from that address to a peer shares it, and the datagrams of any peer are
+// written back to the address, just like a full-cone NAT does.
+type udpNAT struct {
+	mutex        sync.Mutex
+	associations map[string]*udpAssociation
+	writers      map[string]*udpWriter
+}
+
+// peerWriter writes the datagrams to the client of the flow as if they were
+// from the peer, which the client hasn't sent to.
+type peerWriter interface {
+	WriteFrom(b []byte, from string) (int, error)
+}
+
+type udpWriter struct {
+	peerWriter
+	refs int
+}
+
+type udpAssociation struct {
+	key   string
+	conn  proxy.PacketConn
+	err   error
+	ready chan struct{}
+	flows map[string]net.Conn
+}
+
+func newUDPNAT() *udpNAT {
+	return &udpNAT{
+		associations: make(map[string]*udpAssociation),
+		writers:      make(map[string]*udpWriter),
+	}
+}
+
+// writeFrom lets the flow of the inbound write the datagrams of the unknown
+// peers to its local source address, until the returned func is called.
+func (n *udpNAT) writeFrom(conn net.Conn, local string) (release func()) {
+	w, ok := conn.(peerWriter)
+	if !ok {
+		return func() {}
+	}
+
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	uw, ok := n.writers[local]
+	if !ok {
+		uw = &udpWriter{peerWriter: w}
+		n.writers[local] = uw
+	}
+	uw.refs++
+
+	return func() {
+		n.mutex.Lock()
+		defer n.mutex.Unlock()
+		if uw.refs--; uw.refs == 0 && n.writers[local] == uw {
+			delete(n.writers, local)
+		}
+	}
+}
+
+func (n *udpNAT) relay(client proxy.PacketClient, conn net.Conn, target string) {
+	defer conn.Close()
+
+	a, err := n.join(client, conn, target)
+	if err != nil {
+		logrus.Warnf("%s failed to associate udp://%s via proxy %s: %v", conn.LocalAddr(), target, client, err)
+		return
+	}
+	defer n.leave(a, conn, target)
+
+	buf := pool.Get(maxDatagramSize)
+	defer pool.Put(buf)
+
+	for {
+		conn.SetReadDeadline(time.Now().Add(proxy.UDPReadTimeout))
+		size, err := conn.Read(buf)
+		if err != nil {
+			return
+		}
+
+		if _, err := a.conn.WriteTo(buf[:size], target); err != nil {
+			logrus.Warnf("%s failed to relay udp://%s via proxy %s: %v", conn.LocalAddr(), target, client, err)
+			return
+		}
+	}
+}
+
+func (n *udpNAT) join(client proxy.PacketClient, conn net.Conn, target string) (*udpAssociation, error) {
+	key := conn.LocalAddr().String()
+
+	n.mutex.Lock()
+	a, ok := n.associations[key]
+	if !ok {
+		a = &udpAssociation{
+			key:   key,
+			ready: make(chan struct{}),
+			flows: make(map[string]net.Conn),
+		}
+		n.associations[key] = a
+	}
+	a.flows[target] = conn
+	n.mutex.Unlock()
+
+	if !ok {
+		a.conn, a.err = client.ListenPacket(context.Background())
+		close(a.ready)
+		if a.err == nil {
+			go n.readLoop(a)
+		}
+	}
+
+	<-a.ready
+	if a.err != nil {
+		n.leave(a, conn, target)
+		return nil, a.err
+	}
+	return a, nil
+}
+
+func (n *udpNAT) leave(a *udpAssociation, conn net.Conn, target string) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	if a.flows[target] == conn {
+		delete(a.flows, target)
+	}
+	if len(a.flows) != 0 {
+		return
+	}
+
+	if n.associations[a.key] == a {
+		delete(n.associations, a.key)
+	}
+	if a.conn != nil {
+		a.conn.Close()
+	}
+}
+
+func (n *udpNAT) readLoop(a *udpAssociation) {
+	buf := pool.Get(maxDatagramSize)
+	defer pool.Put(buf)
+
+	for {
+		size, from, err := a.conn.ReadFrom(buf)
+		if err != nil {
+			break
+		}
+
+		n.mutex.Lock()
+		flow := a.flows[from]
+		w := n.writers[a.key]
+		n.mutex.Unlock()
+
+		if flow != nil {
+			flow.Write(buf[:size])
+			continue
+		}
+		if w == nil {
+			logrus.Debugf("%s drop udp from unknown peer %s", a.key, from)
+			continue
+		}
+		if _, err := w.WriteFrom(buf[:size], from); err != nil {
+			logrus.Debugf("%s drop udp from unknown peer %s: %v", a.key, from, err)
+		}
+	}
+
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	for _, flow := range a.flows {
+		flow.Close()
+	}
+	if n.associations[a.key] == a {
+		delete(n.associations, a.key)
+	}
+}
@@ -0,0 +1,94 @@
+package system
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/fanpei91/spn/dialer"
+	"github.com/fanpei91/spn/proxy"
+	"github.com/stretchr/testify/require"
+)
+
+type datagram struct {
+	b    []byte
+	addr string
+}
+
+// fakePacketConn is an association whose peers are played by the test.
+type fakePacketConn struct {
+	in  chan datagram
+	out chan datagram
+}
+
+func newFakePacketConn() *fakePacketConn {
+	return &fakePacketConn{in: make(chan datagram, 8), out: make(chan datagram, 8)}
+}
+
+func (c *fakePacketConn) ReadFrom(p []byte) (int, string, error) {
+	d, ok := <-c.in
+	if !ok {
+		return 0, "", net.ErrClosed
+	}
+	return copy(p, d.b), d.addr, nil
+}
+
+func (c *fakePacketConn) WriteTo(p []byte, addr string) (int, error) {
+	c.out <- datagram{b: append([]byte(nil), p...), addr: addr}
+	return len(p), nil
+}
+
+func (c *fakePacketConn) Close() error {
+	return nil
+}
+
+func (c *fakePacketConn) ListenPacket(context.Context) (proxy.PacketConn, error) {
+	return c, nil
+}
+
+func (c *fakePacketConn) String() string {
+	return "fake"
+}
+
+// peerFlow records the datagrams written from the unknown peers.
+type peerFlow struct {
+	dialer.Conn
+	from chan datagram
+}
+
+func (f peerFlow) WriteFrom(b []byte, from string) (int, error) {
+	f.from <- datagram{b: append([]byte(nil), b...), addr: from}
+	return len(b), nil
+}
+
+func TestUDPNATFullCone(t *testing.T) {
+	n := newUDPNAT()
+	pc := newFakePacketConn()
+	defer close(pc.in)
+
+	client, server := net.Pipe()
+	defer client.Close()
+	flow := peerFlow{
+		Conn: dialer.Conn{
+			Conn:   server,
+			Local:  &net.UDPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 5353},
+			Remote: &net.UDPAddr{IP: net.IPv4(1, 1, 1, 1), Port: 3478},
+		},
+		from: make(chan datagram, 1),
+	}
+	defer n.writeFrom(flow, flow.LocalAddr().String())()
+	go n.relay(pc, flow, "1.1.1.1:3478")
+
+	_, err := client.Write([]byte("binding"))
+	require.NoError(t, err)
+	require.Equal(t, datagram{b: []byte("binding"), addr: "1.1.1.1:3478"}, <-pc.out)
+
+	pc.in <- datagram{b: []byte("reply"), addr: "1.1.1.1:3478"}
+	buf := make([]byte, 16)
+	size, err := client.Read(buf)
+	require.NoError(t, err)
+	require.Equal(t, "reply", string(buf[:size]))
+
+	pc.in <- datagram{b: []byte("punch"), addr: "2.2.2.2:4000"}
+	require.Equal(t, datagram{b: []byte("punch"), addr: "2.2.2.2:4000"}, <-flow.from)
+}
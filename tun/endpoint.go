@@ -10,30 +10,84 @@ import (
 	"gvisor.dev/gvisor/pkg/tcpip/stack"
 )
 
+// device reads and writes one packet per call at the offset of the buffer,
+// the room ahead of which is left for the header of the device, as
+// tun.Device does.
+type device interface {
+	Read(buf []byte, offset int) (int, error)
+	Write(buf []byte, offset int) (int, error)
+	Close() error
+}
+
+// batchDevice reads many packets per call into the buffers at the offset,
+// as tun.Device of the later wireguard-go does, and tells how many buffers
+// it fills at most.
+type batchDevice interface {
+	device
+	ReadBatch(bufs [][]byte, sizes []int, offset int) (int, error)
+	BatchSize() int
+}
+
+type rwcDevice struct {
+	io.ReadWriteCloser
+}
+
+func (d rwcDevice) Read(buf []byte, offset int) (int, error) {
+	return d.ReadWriteCloser.Read(buf[offset:])
+}
+
+func (d rwcDevice) Write(buf []byte, offset int) (int, error) {
+	return d.ReadWriteCloser.Write(buf[offset:])
+}
+
 // The all following code is from https://github.com/xjasonlyu/tun2socks
 type endpoint struct {
-	mtu uint32
-	rwc io.ReadWriteCloser
-	wg  sync.WaitGroup
-
+	mtu    uint32
+	dev    device
+	offset int
+	bufs   sync.Pool
+	wg     sync.WaitGroup
+	once   sync.Once
+
+	mutex              sync.RWMutex
 	dispatcher         stack.NetworkDispatcher
 	LinkEPCapabilities stack.LinkEndpointCapabilities
 }
 
-func newEndpoint(rwc io.ReadWriteCloser, mtu uint32) *endpoint {
-	return &endpoint{
-		rwc: rwc,
-		mtu: mtu,
+func newEndpoint(dev device, offset int, mtu uint32) *endpoint {
+	e := &endpoint{
+		dev:    dev,
+		offset: offset,
+		mtu:    mtu,
+	}
+	e.bufs.New = func() interface{} {
+		buf := make([]byte, offset+int(mtu))
+		return &buf
 	}
+	return e
 }
 
 func (e *endpoint) Attach(dispatcher stack.NetworkDispatcher) {
-	go e.dispatchLoop()
+	e.mutex.Lock()
 	e.dispatcher = dispatcher
+	e.mutex.Unlock()
+
+	if dispatcher != nil {
+		e.once.Do(func() {
+			e.wg.Add(1)
+			go e.dispatchLoop()
+		})
+	}
 }
 
 func (e *endpoint) IsAttached() bool {
-	return e.dispatcher != nil
+	return e.getDispatcher() != nil
+}
+
+func (e *endpoint) getDispatcher() stack.NetworkDispatcher {
+	e.mutex.RLock()
+	defer e.mutex.RUnlock()
+	return e.dispatcher
 }
 
 func (e *endpoint) WritePacket(_ *stack.Route, _ *stack.GSO, _ tcpip.NetworkProtocolNumber, pkt *stack.PacketBuffer) *tcpip.Error {
@@ -79,49 +133,99 @@ func (e *endpoint) Wait() {
 }
 
 func (e *endpoint) Close() error {
-	return e.rwc.Close()
+	return e.dev.Close()
 }
 
+// dispatchLoop reads the packets into buffers of the mtu, and hands them to
+// the stack, which keeps them as long as it needs. A packet of at least half
+// of its buffer is handed over in place, and another buffer is made for the
+// next read. The smaller ones are copied to their exact sizes, and their
+// buffers are read into again, so that the stack keeps at most twice the
+// memory of the packets.
 func (e *endpoint) dispatchLoop() {
-	e.wg.Add(1)
 	defer e.wg.Done()
 
-	for {
-		packet := make([]byte, e.mtu)
-		n, err := e.rwc.Read(packet)
-		if err != nil {
-			break
+	bufs := make([][]byte, 1)
+	read := func(bufs [][]byte, sizes []int) (int, error) {
+		n, err := e.dev.Read(bufs[0], e.offset)
+		sizes[0] = n
+		return 1, err
+	}
+	if d, ok := e.dev.(batchDevice); ok && d.BatchSize() > 1 {
+		bufs = make([][]byte, d.BatchSize())
+		read = func(bufs [][]byte, sizes []int) (int, error) {
+			return d.ReadBatch(bufs, sizes, e.offset)
 		}
+	}
+	sizes := make([]int, len(bufs))
 
-		if !e.IsAttached() {
-			continue
+	size := e.offset + int(e.mtu)
+	for i := range bufs {
+		bufs[i] = make([]byte, size)
+	}
+
+	for {
+		count, err := read(bufs, sizes)
+		for i := 0; i < count; i++ {
+			if sizes[i] == 0 {
+				continue
+			}
+
+			packet := bufs[i][e.offset : e.offset+sizes[i]]
+			if 2*len(packet) >= len(bufs[i]) {
+				bufs[i] = make([]byte, size)
+			} else {
+				packet = append(buffer.View(nil), packet...)
+			}
+			e.deliver(packet)
 		}
 
-		var p tcpip.NetworkProtocolNumber
-		switch header.IPVersion(packet) {
-		case header.IPv4Version:
-			p = header.IPv4ProtocolNumber
-		case header.IPv6Version:
-			p = header.IPv6ProtocolNumber
+		if err != nil {
+			break
 		}
+	}
+}
 
-		e.dispatcher.DeliverNetworkPacket("", "", p, &stack.PacketBuffer{
-			Data: buffer.View(packet[:n]).ToVectorisedView(),
-		})
+func (e *endpoint) deliver(packet buffer.View) {
+	dispatcher := e.getDispatcher()
+	if dispatcher == nil {
+		return
+	}
+
+	var p tcpip.NetworkProtocolNumber
+	switch header.IPVersion(packet) {
+	case header.IPv4Version:
+		p = header.IPv4ProtocolNumber
+	case header.IPv6Version:
+		p = header.IPv6ProtocolNumber
 	}
+
+	dispatcher.DeliverNetworkPacket("", "", p, stack.NewPacketBuffer(stack.PacketBufferOptions{
+		Data: packet.ToVectorisedView(),
+	}))
 }
 
+// writePacket gathers the headers and the payload behind the room for the
+// header of the device in a pooled buffer, which is written as it is.
 func (e *endpoint) writePacket(pkt *stack.PacketBuffer) *tcpip.Error {
-	networkHdr := pkt.NetworkHeader().View()
-	transportHdr := pkt.TransportHeader().View()
-	payload := pkt.Data.ToView()
+	size := e.offset + pkt.Size()
 
-	buf := buffer.NewVectorisedView(
-		len(networkHdr)+len(transportHdr)+len(payload),
-		[]buffer.View{networkHdr, transportHdr, payload},
-	)
+	bp := e.bufs.Get().(*[]byte)
+	defer e.bufs.Put(bp)
+	if len(*bp) < size {
+		*bp = make([]byte, size)
+	}
+	buf := (*bp)[:size]
+
+	n := e.offset
+	n += copy(buf[n:], pkt.LinkHeader().View())
+	n += copy(buf[n:], pkt.NetworkHeader().View())
+	n += copy(buf[n:], pkt.TransportHeader().View())
+	for _, v := range pkt.Data.Views() {
+		n += copy(buf[n:], v)
+	}
 
-	if _, err := e.rwc.Write(buf.ToView()); err != nil {
+	if _, err := e.dev.Write(buf, e.offset); err != nil {
 		return tcpip.ErrInvalidEndpointState
 	}
 
@@ -0,0 +1,214 @@
+package tun
+
+import (
+	"io"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/buffer"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+)
+
+// benchDevice reads the same packet n times, and discards the written ones.
+type benchDevice struct {
+	packet []byte
+	n      int
+}
+
+func (d *benchDevice) Read(buf []byte, offset int) (int, error) {
+	if d.n == 0 {
+		return 0, io.EOF
+	}
+	d.n--
+	return copy(buf[offset:], d.packet), nil
+}
+
+func (d *benchDevice) Write(buf []byte, offset int) (int, error) {
+	return len(buf) - offset, nil
+}
+
+func (d *benchDevice) Close() error {
+	return nil
+}
+
+// benchBatchDevice reads the same packet into all the buffers at a time.
+type benchBatchDevice struct {
+	benchDevice
+}
+
+func (d *benchBatchDevice) ReadBatch(bufs [][]byte, sizes []int, offset int) (int, error) {
+	n := 0
+	for ; n < len(bufs) && d.n > 0; n++ {
+		sizes[n], _ = d.Read(bufs[n], offset)
+	}
+	if n == 0 {
+		return 0, io.EOF
+	}
+	return n, nil
+}
+
+func (d *benchBatchDevice) BatchSize() int {
+	return 16
+}
+
+type discardDispatcher struct{}
+
+func (discardDispatcher) DeliverNetworkPacket(_, _ tcpip.LinkAddress, _ tcpip.NetworkProtocolNumber, _ *stack.PacketBuffer) {
+}
+
+func (discardDispatcher) DeliverOutboundPacket(_, _ tcpip.LinkAddress, _ tcpip.NetworkProtocolNumber, _ *stack.PacketBuffer) {
+}
+
+func benchmarkDispatch(b *testing.B, size int, batch bool) {
+	src := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 5353}
+	dst := &net.UDPAddr{IP: net.IPv4(1, 1, 1, 1), Port: 53}
+	packet := udpPacket(src, dst, make([]byte, size))
+
+	b.SetBytes(int64(len(packet)))
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	var dev device = &benchDevice{packet: packet, n: b.N}
+	if batch {
+		dev = &benchBatchDevice{benchDevice{packet: packet, n: b.N}}
+	}
+	e := newEndpoint(dev, offset, 1500)
+	e.Attach(discardDispatcher{})
+	e.Wait()
+}
+
+func BenchmarkEndpointDispatchSmall(b *testing.B) {
+	benchmarkDispatch(b, 12, false)
+}
+
+func BenchmarkEndpointDispatchFull(b *testing.B) {
+	benchmarkDispatch(b, 1500-header.IPv4MinimumSize-header.UDPMinimumSize, false)
+}
+
+func BenchmarkEndpointDispatchBatch(b *testing.B) {
+	benchmarkDispatch(b, 1500-header.IPv4MinimumSize-header.UDPMinimumSize, true)
+}
+
+func BenchmarkEndpointWrite(b *testing.B) {
+	const payloadSize = 1500 - header.IPv4MinimumSize - header.TCPMinimumSize
+
+	pkt := stack.NewPacketBuffer(stack.PacketBufferOptions{
+		ReserveHeaderBytes: header.IPv4MinimumSize + header.TCPMinimumSize,
+		Data:               buffer.NewView(payloadSize).ToVectorisedView(),
+	})
+	pkt.TransportHeader().Push(header.TCPMinimumSize)
+	pkt.NetworkHeader().Push(header.IPv4MinimumSize)
+
+	e := newEndpoint(&benchDevice{}, offset, 1500)
+
+	b.SetBytes(int64(pkt.Size()))
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		if err := e.WritePacket(nil, nil, header.IPv4ProtocolNumber, pkt); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+type recordDevice struct {
+	benchDevice
+	written []byte
+}
+
+func (d *recordDevice) Write(buf []byte, offset int) (int, error) {
+	d.written = append([]byte(nil), buf...)
+	return len(buf) - offset, nil
+}
+
+func TestEndpointWrite(t *testing.T) {
+	pkt := stack.NewPacketBuffer(stack.PacketBufferOptions{
+		ReserveHeaderBytes: 2,
+		Data:               buffer.NewVectorisedView(4, []buffer.View{{5, 6}, {7, 8}}),
+	})
+	copy(pkt.TransportHeader().Push(1), []byte{2})
+	copy(pkt.NetworkHeader().Push(1), []byte{1})
+
+	dev := &recordDevice{}
+	e := newEndpoint(dev, offset, 1500)
+	require.Nil(t, e.WritePacket(nil, nil, header.IPv4ProtocolNumber, pkt))
+	require.Equal(t, []byte{1, 2, 5, 6, 7, 8}, dev.written[offset:])
+}
+
+// recordDispatcher keeps the packets delivered as they are.
+type recordDispatcher struct {
+	discardDispatcher
+	packets []buffer.View
+}
+
+func (d *recordDispatcher) DeliverNetworkPacket(_, _ tcpip.LinkAddress, _ tcpip.NetworkProtocolNumber, pkt *stack.PacketBuffer) {
+	d.packets = append(d.packets, pkt.Data.ToView())
+}
+
+func TestEndpointDispatch(t *testing.T) {
+	src := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 5353}
+	dst := &net.UDPAddr{IP: net.IPv4(1, 1, 1, 1), Port: 53}
+
+	var packets [][]byte
+	for i := 0; i < 200; i++ {
+		packets = append(packets, udpPacket(src, dst, make([]byte, i*7)))
+		packets[i][len(packets[i])-1] = byte(i)
+	}
+
+	for _, batch := range []bool{false, true} {
+		var dev device = &sequenceDevice{packets: packets}
+		if batch {
+			dev = &batchSequenceDevice{sequenceDevice{packets: packets}}
+		}
+
+		d := &recordDispatcher{}
+		e := newEndpoint(dev, offset, 1500)
+		e.Attach(d)
+		e.Wait()
+
+		require.Len(t, d.packets, len(packets))
+		for i, packet := range packets {
+			require.Equal(t, buffer.View(packet), d.packets[i])
+			// The stack keeps no more than twice the memory of a packet.
+			require.LessOrEqual(t, cap(d.packets[i]), 2*len(packet)+offset)
+		}
+	}
+}
+
+// sequenceDevice reads the packets one after another.
+type sequenceDevice struct {
+	benchDevice
+	packets [][]byte
+}
+
+func (d *sequenceDevice) Read(buf []byte, offset int) (int, error) {
+	if len(d.packets) == 0 {
+		return 0, io.EOF
+	}
+	n := copy(buf[offset:], d.packets[0])
+	d.packets = d.packets[1:]
+	return n, nil
+}
+
+type batchSequenceDevice struct {
+	sequenceDevice
+}
+
+func (d *batchSequenceDevice) ReadBatch(bufs [][]byte, sizes []int, offset int) (int, error) {
+	n := 0
+	for ; n < len(bufs) && len(d.packets) > 0; n++ {
+		sizes[n], _ = d.Read(bufs[n], offset)
+	}
+	if n == 0 {
+		return 0, io.EOF
+	}
+	return n, nil
+}
+
+func (d *batchSequenceDevice) BatchSize() int {
+	return 4
+}
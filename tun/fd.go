@@ -0,0 +1,19 @@
+// +build !windows
+
+package tun
+
+import (
+	"os"
+
+	"golang.zx2c4.com/wireguard/tun"
+)
+
+// NewFromFd listens on the tun device of the file descriptor, which is opened
+// by someone else, e.g. the parent process or the VPN service of the system.
+func NewFromFd(fd int, mtu int, backlog int) (*Listener, error) {
+	device, err := tun.CreateTUNFromFile(os.NewFile(uintptr(fd), "tun"), mtu)
+	if err != nil {
+		return nil, err
+	}
+	return listenDevice(device, backlog)
+}
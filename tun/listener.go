@@ -1,11 +1,15 @@
 package tun
 
 import (
+	"context"
 	"errors"
+	"fmt"
+	"io"
 	"net"
+	"sync"
+	"sync/atomic"
 	"time"
 
-	"github.com/Dreamacro/clash/common/pool"
 	"github.com/fanpei91/spn/dialer"
 	"golang.zx2c4.com/wireguard/tun"
 	"gvisor.dev/gvisor/pkg/tcpip"
@@ -19,24 +23,69 @@ import (
 	"gvisor.dev/gvisor/pkg/waiter"
 )
 
+// DefaultBacklog is the number of the connections waiting to be accepted,
+// beyond which the new ones are dropped.
+const DefaultBacklog = 128
+
 type Listener struct {
-	stack  *stack.Stack
-	tcpCh  chan net.Conn
-	udpCh  chan net.Conn
-	closed bool
-	ep     *endpoint
-	iface  string
+	stack     *stack.Stack
+	tcpCh     chan net.Conn
+	udpCh     chan net.Conn
+	mutex     sync.RWMutex
+	done      chan struct{}
+	closeOnce sync.Once
+	ep        *endpoint
+	iface     string
+
+	tcpDrops uint64
+	udpDrops uint64
+}
+
+// Stats counts the connections dropped since the backlog was full.
+type Stats struct {
+	TCPDrops uint64
+	UDPDrops uint64
+}
+
+// Listen creates the tun device of the name, and listens on it.
+func Listen(name string, mtu int, backlog int) (*Listener, error) {
+	device, err := tun.CreateTUN(name, mtu)
+	if err != nil {
+		return nil, err
+	}
+	return listenDevice(device, backlog)
 }
 
-func Listen(mtu int) (*Listener, error) {
-	device, err := tun.CreateTUN("utun", mtu)
+func listenDevice(device tun.Device, backlog int) (*Listener, error) {
+	mtu, err := device.MTU()
 	if err != nil {
+		device.Close()
 		return nil, err
 	}
 
-	if mtu, err = device.MTU(); err != nil {
+	l, err := newListener(device, offset, mtu, backlog)
+	if err != nil {
+		device.Close()
 		return nil, err
 	}
+	l.iface, _ = device.Name()
+	return l, nil
+}
+
+// New listens on the IP packets read from rwc, which writes the packets back,
+// one packet per call. Up to backlog connections of each network wait to be
+// accepted, or DefaultBacklog if it isn't positive.
+func New(rwc io.ReadWriteCloser, mtu int, backlog int) (*Listener, error) {
+	return newListener(rwcDevice{rwc}, 0, mtu, backlog)
+}
+
+func newListener(dev device, offset int, mtu int, backlog int) (*Listener, error) {
+	if mtu <= 0 {
+		return nil, fmt.Errorf("invalid mtu %d", mtu)
+	}
+	if backlog <= 0 {
+		backlog = DefaultBacklog
+	}
 
 	s := stack.New(
 		stack.Options{
@@ -51,14 +100,14 @@ func Listen(mtu int) (*Listener, error) {
 		},
 	)
 
-	ep := newEndpoint(&unixTun{device: device}, uint32(mtu))
+	ep := newEndpoint(dev, offset, uint32(mtu))
 	l := &Listener{
 		stack: s,
-		tcpCh: make(chan net.Conn, 1),
-		udpCh: make(chan net.Conn, 1),
+		tcpCh: make(chan net.Conn, backlog),
+		udpCh: make(chan net.Conn, backlog),
+		done:  make(chan struct{}),
 		ep:    ep,
 	}
-	l.iface, _ = device.Name()
 
 	s.SetForwarding(ipv4.ProtocolNumber, true)
 	s.SetForwarding(ipv6.ProtocolNumber, true)
@@ -72,7 +121,10 @@ func Listen(mtu int) (*Listener, error) {
 	withTCPCongestionControl(s)
 	withTCPModerateReceiveBuffer(s)
 
-	s.CreateNIC(1, ep)
+	if err := s.CreateNIC(1, ep); err != nil {
+		s.Close()
+		return nil, errors.New(err.String())
+	}
 	s.SetRouteTable([]tcpip.Route{
 		{
 			Destination: header.IPv4EmptySubnet,
@@ -89,31 +141,95 @@ func Listen(mtu int) (*Listener, error) {
 	return l, nil
 }
 
+// Iface is the name of the tun device, which is empty if the listener isn't
+// on one.
 func (l *Listener) Iface() string {
 	return l.iface
 }
 
-func (l *Listener) AcceptTCP() net.Conn {
-	return <-l.tcpCh
+// AcceptTCP waits for the next TCP connection, and fails with net.ErrClosed
+// once the listener is closed.
+func (l *Listener) AcceptTCP() (net.Conn, error) {
+	return l.AcceptTCPContext(context.Background())
+}
+
+func (l *Listener) AcceptTCPContext(ctx context.Context) (net.Conn, error) {
+	return l.accept(ctx, l.tcpCh)
+}
+
+// AcceptUDP waits for the next UDP association, and fails with net.ErrClosed
+// once the listener is closed.
+func (l *Listener) AcceptUDP() (net.Conn, error) {
+	return l.AcceptUDPContext(context.Background())
+}
+
+func (l *Listener) AcceptUDPContext(ctx context.Context) (net.Conn, error) {
+	return l.accept(ctx, l.udpCh)
+}
+
+func (l *Listener) accept(ctx context.Context, ch chan net.Conn) (net.Conn, error) {
+	select {
+	case <-l.done:
+		return nil, net.ErrClosed
+	default:
+	}
+
+	select {
+	case conn := <-ch:
+		return conn, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (l *Listener) Stats() Stats {
+	return Stats{
+		TCPDrops: atomic.LoadUint64(&l.tcpDrops),
+		UDPDrops: atomic.LoadUint64(&l.udpDrops),
+	}
 }
 
-func (l *Listener) AcceptUDP() net.Conn {
-	return <-l.udpCh
+// enqueue hands the connection to Accept without blocking the forwarder, or
+// closes it if the backlog is full or the listener is closed.
+func (l *Listener) enqueue(ch chan net.Conn, conn net.Conn, drops *uint64) {
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+
+	if l.isClosed() {
+		conn.Close()
+		return
+	}
+
+	select {
+	case ch <- conn:
+	default:
+		atomic.AddUint64(drops, 1)
+		conn.Close()
+	}
 }
 
 func (l *Listener) setTCPHandler() {
 	forwarder := tcp.NewForwarder(l.stack, 2<<10, 2<<10, func(r *tcp.ForwarderRequest) {
+		if l.isClosed() || len(l.tcpCh) == cap(l.tcpCh) {
+			atomic.AddUint64(&l.tcpDrops, 1)
+			r.Complete(true)
+			return
+		}
+
 		var wq waiter.Queue
 		id := r.ID()
 		ep, err := r.CreateEndpoint(&wq)
 		if err != nil {
+			r.Complete(true)
 			return
 		}
 
 		setKeepalive(ep)
 
 		r.Complete(false)
-		l.tcpCh <- newTunConn(id, gonet.NewTCPConn(&wq, ep))
+		l.enqueue(l.tcpCh, newTunConn(id, gonet.NewTCPConn(&wq, ep)), &l.tcpDrops)
 	})
 
 	l.stack.SetTransportProtocolHandler(tcp.ProtocolNumber, forwarder.HandlePacket)
@@ -149,26 +265,42 @@ func (l *Listener) setUDPHandler() {
 			return
 		}
 
-		l.udpCh <- newTunConn(id, gonet.NewUDPConn(l.stack, &wq, ep))
+		conn := udpConn{Conn: newTunConn(id, gonet.NewUDPConn(l.stack, &wq, ep)), l: l}
+		l.enqueue(l.udpCh, conn, &l.udpDrops)
 	})
 
 	l.stack.SetTransportProtocolHandler(udp.ProtocolNumber, forwarder.HandlePacket)
 }
 
+// Close stops accepting, and returns once the packets are no longer read.
+// The connections waiting to be accepted are closed.
 func (l *Listener) Close() error {
-	if l.closed {
-		return errors.New("use of closed network connection")
-	}
-
-	l.closed = true
-
-	l.stack.Close()
-	l.ep.Close()
-
-	close(l.udpCh)
-	close(l.tcpCh)
+	err := net.ErrClosed
+	l.closeOnce.Do(func() {
+		l.mutex.Lock()
+		close(l.done)
+		l.mutex.Unlock()
+
+		l.stack.Close()
+		err = l.ep.Close()
+		l.ep.Wait()
+
+		for _, ch := range []chan net.Conn{l.tcpCh, l.udpCh} {
+			for len(ch) > 0 {
+				(<-ch).Close()
+			}
+		}
+	})
+	return err
+}
 
-	return nil
+func (l *Listener) isClosed() bool {
+	select {
+	case <-l.done:
+		return true
+	default:
+		return false
+	}
 }
 
 func newTunConn(id stack.TransportEndpointID, conn net.Conn) dialer.Conn {
@@ -226,31 +358,3 @@ func withTCPModerateReceiveBuffer(s *stack.Stack) {
 	opt := tcpip.TCPModerateReceiveBufferOption(true)
 	s.SetTransportProtocolOption(tcp.ProtocolNumber, &opt)
 }
-
-type unixTun struct {
-	device tun.Device
-}
-
-func (t *unixTun) Read(packet []byte) (n int, err error) {
-	buf := pool.Get(offset + len(packet))
-	defer pool.Put(buf)
-
-	if n, err = t.device.Read(buf, offset); err != nil {
-		return
-	}
-
-	copy(packet, buf[offset:offset+n])
-	return
-}
-
-func (t *unixTun) Write(packet []byte) (int, error) {
-	buf := pool.Get(offset + len(packet))
-	defer pool.Put(buf)
-
-	copy(buf[offset:], packet)
-	return t.device.Write(buf[:offset+len(packet)], offset)
-}
-
-func (t *unixTun) Close() error {
-	return t.device.Close()
-}
@@ -0,0 +1,161 @@
+package tun
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+)
+
+func udpPacket(src, dst *net.UDPAddr, payload []byte) []byte {
+	b := make([]byte, header.IPv4MinimumSize+header.UDPMinimumSize+len(payload))
+
+	ip := header.IPv4(b)
+	ip.Encode(&header.IPv4Fields{
+		TotalLength: uint16(len(b)),
+		TTL:         64,
+		Protocol:    uint8(header.UDPProtocolNumber),
+		SrcAddr:     tcpip.Address(src.IP.To4()),
+		DstAddr:     tcpip.Address(dst.IP.To4()),
+	})
+	ip.SetChecksum(^ip.CalculateChecksum())
+
+	udp := header.UDP(ip.Payload())
+	udp.Encode(&header.UDPFields{
+		SrcPort: uint16(src.Port),
+		DstPort: uint16(dst.Port),
+		Length:  uint16(header.UDPMinimumSize + len(payload)),
+	})
+	copy(udp.Payload(), payload)
+	return b
+}
+
+func TestListenerUDP(t *testing.T) {
+	device, rwc := net.Pipe()
+	defer device.Close()
+
+	l, err := New(rwc, 1500, 0)
+	require.NoError(t, err)
+	defer l.Close()
+	require.Empty(t, l.Iface())
+
+	src := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 5353}
+	dst := &net.UDPAddr{IP: net.IPv4(1, 1, 1, 1), Port: 53}
+	go device.Write(udpPacket(src, dst, []byte("ping")))
+
+	conn, err := l.AcceptUDP()
+	require.NoError(t, err)
+	require.Equal(t, src.String(), conn.LocalAddr().String())
+	require.Equal(t, dst.String(), conn.RemoteAddr().String())
+
+	buf := make([]byte, 1500)
+	n, err := conn.Read(buf)
+	require.NoError(t, err)
+	require.Equal(t, "ping", string(buf[:n]))
+
+	go conn.Write([]byte("pong"))
+
+	n, err = device.Read(buf)
+	require.NoError(t, err)
+	ip := header.IPv4(buf[:n])
+	require.Equal(t, tcpip.Address(dst.IP.To4()), ip.SourceAddress())
+	require.Equal(t, tcpip.Address(src.IP.To4()), ip.DestinationAddress())
+
+	udp := header.UDP(ip.Payload())
+	require.Equal(t, uint16(src.Port), udp.DestinationPort())
+	require.Equal(t, "pong", string(udp.Payload()))
+}
+
+func TestListenerUDPFromPeer(t *testing.T) {
+	device, rwc := net.Pipe()
+	defer device.Close()
+
+	l, err := New(rwc, 1500, 0)
+	require.NoError(t, err)
+	defer l.Close()
+
+	src := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 5353}
+	dst := &net.UDPAddr{IP: net.IPv4(1, 1, 1, 1), Port: 3478}
+	go device.Write(udpPacket(src, dst, []byte("binding")))
+
+	conn, err := l.AcceptUDP()
+	require.NoError(t, err)
+	w, ok := conn.(interface {
+		WriteFrom(b []byte, from string) (int, error)
+	})
+	require.True(t, ok)
+
+	go w.WriteFrom([]byte("punch"), "2.2.2.2:4000")
+
+	buf := make([]byte, 1500)
+	n, err := device.Read(buf)
+	require.NoError(t, err)
+	ip := header.IPv4(buf[:n])
+	require.True(t, ip.IsValid(n))
+	require.Equal(t, tcpip.Address(net.IPv4(2, 2, 2, 2).To4()), ip.SourceAddress())
+	require.Equal(t, tcpip.Address(src.IP.To4()), ip.DestinationAddress())
+
+	udp := header.UDP(ip.Payload())
+	require.Equal(t, uint16(4000), udp.SourcePort())
+	require.Equal(t, uint16(src.Port), udp.DestinationPort())
+	require.Equal(t, "punch", string(udp.Payload()))
+	xsum := header.PseudoHeaderChecksum(header.UDPProtocolNumber, ip.SourceAddress(), ip.DestinationAddress(), uint16(len(udp)))
+	require.Equal(t, uint16(0xffff), header.Checksum(udp, xsum))
+
+	_, err = w.WriteFrom([]byte("punch"), "[2001:db8::1]:4000")
+	require.Error(t, err)
+}
+
+func TestListenerClose(t *testing.T) {
+	device, rwc := net.Pipe()
+	defer device.Close()
+
+	l, err := New(rwc, 1500, 0)
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err = l.AcceptTCPContext(ctx)
+	require.Equal(t, context.DeadlineExceeded, err)
+
+	accepted := make(chan error, 1)
+	go func() {
+		_, err := l.AcceptUDP()
+		accepted <- err
+	}()
+
+	require.NoError(t, l.Close())
+	require.Equal(t, net.ErrClosed, <-accepted)
+
+	_, err = l.AcceptTCP()
+	require.Equal(t, net.ErrClosed, err)
+	require.Equal(t, net.ErrClosed, l.Close())
+}
+
+func TestListenerBacklog(t *testing.T) {
+	device, rwc := net.Pipe()
+	defer device.Close()
+
+	l, err := New(rwc, 1500, 1)
+	require.NoError(t, err)
+	defer l.Close()
+
+	dst := &net.UDPAddr{IP: net.IPv4(1, 1, 1, 1), Port: 53}
+	for port := 5353; port < 5356; port++ {
+		src := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 2), Port: port}
+		_, err := device.Write(udpPacket(src, dst, []byte("ping")))
+		require.NoError(t, err)
+	}
+
+	require.Eventually(t, func() bool {
+		return l.Stats().UDPDrops == 2
+	}, time.Second, 10*time.Millisecond)
+
+	conn, err := l.AcceptUDP()
+	require.NoError(t, err)
+	require.Equal(t, "10.0.0.2:5353", conn.LocalAddr().String())
+}
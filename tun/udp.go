@@ -0,0 +1,102 @@
+package tun
+
+import (
+	"errors"
+	"net"
+	"strconv"
+
+	"github.com/fanpei91/spn/dialer"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+)
+
+var (
+	errInvalidPeer = errors.New("invalid peer address")
+	errTooLarge    = errors.New("datagram larger than the mtu")
+)
+
+// udpConn is a UDP flow of the tun, which can also write the datagrams to
+// its client from the other peers, which the client hasn't sent to.
+type udpConn struct {
+	dialer.Conn
+	l *Listener
+}
+
+// WriteFrom writes the datagram to the client as if it were from the peer.
+func (c udpConn) WriteFrom(b []byte, from string) (int, error) {
+	host, port, err := net.SplitHostPort(from)
+	if err != nil {
+		return 0, err
+	}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return 0, err
+	}
+	client := c.Local.(dialer.Addr)
+
+	if err := c.l.writeUDP(b, net.ParseIP(host), int(p), client.IP, client.Port); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// writeUDP writes the IP packet of the datagram to the device, past the
+// stack, which only sends from the flows it has.
+func (l *Listener) writeUDP(b []byte, srcIP net.IP, srcPort int, dstIP net.IP, dstPort int) error {
+	if srcIP == nil || (srcIP.To4() == nil) != (dstIP.To4() == nil) {
+		return errInvalidPeer
+	}
+
+	var src, dst tcpip.Address
+	ipHeaderSize := header.IPv4MinimumSize
+	if dstIP.To4() != nil {
+		src, dst = tcpip.Address(srcIP.To4()), tcpip.Address(dstIP.To4())
+	} else {
+		src, dst = tcpip.Address(srcIP.To16()), tcpip.Address(dstIP.To16())
+		ipHeaderSize = header.IPv6MinimumSize
+	}
+
+	udpSize := header.UDPMinimumSize + len(b)
+	if ipHeaderSize+udpSize > int(l.ep.mtu) {
+		return errTooLarge
+	}
+
+	buf := make([]byte, l.ep.offset+ipHeaderSize+udpSize)
+	packet := buf[l.ep.offset:]
+	if ipHeaderSize == header.IPv4MinimumSize {
+		ip := header.IPv4(packet)
+		ip.Encode(&header.IPv4Fields{
+			TotalLength: uint16(len(packet)),
+			TTL:         64,
+			Protocol:    uint8(header.UDPProtocolNumber),
+			SrcAddr:     src,
+			DstAddr:     dst,
+		})
+		ip.SetChecksum(^ip.CalculateChecksum())
+	} else {
+		header.IPv6(packet).Encode(&header.IPv6Fields{
+			PayloadLength:     uint16(udpSize),
+			TransportProtocol: header.UDPProtocolNumber,
+			HopLimit:          64,
+			SrcAddr:           src,
+			DstAddr:           dst,
+		})
+	}
+
+	udp := header.UDP(packet[ipHeaderSize:])
+	udp.Encode(&header.UDPFields{
+		SrcPort: uint16(srcPort),
+		DstPort: uint16(dstPort),
+		Length:  uint16(udpSize),
+	})
+	copy(udp.Payload(), b)
+	xsum := header.PseudoHeaderChecksum(header.UDPProtocolNumber, src, dst, uint16(udpSize))
+	xsum = header.Checksum(b, xsum)
+	if xsum = ^udp.CalculateChecksum(xsum); xsum == 0 {
+		xsum = 0xffff
+	}
+	udp.SetChecksum(xsum)
+
+	_, err := l.ep.dev.Write(buf, l.ep.offset)
+	return err
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/fanpei91/spn/proxy"
+)
+
+const userUsage = `usage: sandwich user <command> [flags]
+
+commands:
+  add     add a user, or update the user of the same name
+  remove  remove a user
+  list    list users and their usage of this month`
+
+func userCommand(args []string) {
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, userUsage)
+		os.Exit(2)
+	}
+
+	var err error
+	switch args[0] {
+	case "add":
+		err = addUser(args[1:])
+	case "remove":
+		err = removeUser(args[1:])
+	case "list":
+		err = listUsers(args[1:])
+	default:
+		fmt.Fprintln(os.Stderr, userUsage)
+		os.Exit(2)
+	}
+
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+func addUser(args []string) error {
+	fs := flag.NewFlagSet("user add", flag.ExitOnError)
+	usersFile := fs.String("users-file", "users.json", "users file")
+	name := fs.String("name", "", "user name")
+	key := fs.String("key", "", "secret key, a random one is generated if empty")
+	quota := fs.String("quota", "0", "monthly quota in bytes, K, M, G and T suffixes are allowed, 0 is unlimited")
+	ports := fs.String("ports", "", "comma separated destination ports allowed, empty allows all")
+	fs.Parse(args)
+
+	if !proxy.ValidUserName(*name) {
+		return fmt.Errorf("invalid user name %q", *name)
+	}
+
+	quotaBytes, err := parseBytes(*quota)
+	if err != nil {
+		return err
+	}
+
+	var allowedPorts []int
+	for _, p := range strings.Split(*ports, ",") {
+		if p = strings.TrimSpace(p); p == "" {
+			continue
+		}
+		port, err := strconv.ParseUint(p, 10, 16)
+		if err != nil {
+			return fmt.Errorf("invalid port %q", p)
+		}
+		allowedPorts = append(allowedPorts, int(port))
+	}
+
+	if *key == "" {
+		b := make([]byte, 16)
+		rand.Read(b)
+		*key = hex.EncodeToString(b)
+	}
+
+	users, err := proxy.LoadUsers(*usersFile)
+	if err != nil {
+		return err
+	}
+
+	user := &proxy.User{Name: *name, Key: *key, Quota: quotaBytes, Ports: allowedPorts}
+	replaced := false
+	for i, u := range users {
+		if u.Name == *name {
+			users[i] = user
+			replaced = true
+		}
+	}
+	if !replaced {
+		users = append(users, user)
+	}
+
+	if err := proxy.SaveUsers(*usersFile, users); err != nil {
+		return err
+	}
+
+	fmt.Printf("user %s, secret key: %s\n", user.Name, user.Key)
+	return nil
+}
+
+func removeUser(args []string) error {
+	fs := flag.NewFlagSet("user remove", flag.ExitOnError)
+	usersFile := fs.String("users-file", "users.json", "users file")
+	name := fs.String("name", "", "user name")
+	fs.Parse(args)
+
+	users, err := proxy.LoadUsers(*usersFile)
+	if err != nil {
+		return err
+	}
+
+	kept := users[:0]
+	for _, u := range users {
+		if u.Name != *name {
+			kept = append(kept, u)
+		}
+	}
+	if len(kept) == len(users) {
+		return fmt.Errorf("no such user %q", *name)
+	}
+
+	return proxy.SaveUsers(*usersFile, kept)
+}
+
+func listUsers(args []string) error {
+	fs := flag.NewFlagSet("user list", flag.ExitOnError)
+	usersFile := fs.String("users-file", "users.json", "users file")
+	fs.Parse(args)
+
+	users, err := proxy.LoadUsers(*usersFile)
+	if err != nil {
+		return err
+	}
+	usage, _ := proxy.LoadUsage(*usersFile)
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tQUOTA\tUSED\tPORTS")
+	for _, u := range users {
+		quota := "unlimited"
+		if u.Quota > 0 {
+			quota = formatBytes(u.Quota)
+		}
+
+		ports := "all"
+		if len(u.Ports) != 0 {
+			ports = strings.Trim(strings.Join(strings.Fields(fmt.Sprint(u.Ports)), ","), "[]")
+		}
+
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", u.Name, quota, formatBytes(usage[u.Name].ThisMonth()), ports)
+	}
+	return w.Flush()
+}
+
+var byteUnits = "KMGT"
+
+func parseBytes(s string) (int64, error) {
+	s = strings.ToUpper(strings.TrimSpace(s))
+	multiplier := int64(1)
+	if s != "" {
+		if i := strings.IndexByte(byteUnits, s[len(s)-1]); i >= 0 {
+			multiplier = 1 << (10 * uint(i+1))
+			s = s[:len(s)-1]
+		}
+	}
+
+	n, err := strconv.ParseFloat(s, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return int64(n * float64(multiplier)), nil
+}
+
+func formatBytes(n int64) string {
+	if n < 1024 {
+		return fmt.Sprintf("%dB", n)
+	}
+	value, unit := float64(n), -1
+	for value >= 1024 && unit < len(byteUnits)-1 {
+		value /= 1024
+		unit++
+	}
+	return fmt.Sprintf("%.1f%c", value, byteUnits[unit])
+}
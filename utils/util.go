@@ -17,7 +17,7 @@ func Exchange(dst io.WriteCloser, src io.ReadCloser) {
 	io.Copy(dst, src)
 }
 
-func HTTPClient(timeout time.Duration, proxy func(*http.Request) (*url.URL, error), proxyHeader http.Header, dns string) *http.Client {
+func HTTPClient(timeout time.Duration, proxy func(*http.Request) (*url.URL, error), proxyHeader func(target string) http.Header, dns string) *http.Client {
 	return &http.Client{
 		Timeout: timeout,
 		Transport: &http.Transport{
@@ -30,7 +30,12 @@ func HTTPClient(timeout time.Duration, proxy func(*http.Request) (*url.URL, erro
 
 				return d.DialContext(ctx, network, addr)
 			},
-			ProxyConnectHeader: proxyHeader,
+			GetProxyConnectHeader: func(ctx context.Context, proxyURL *url.URL, target string) (http.Header, error) {
+				if proxyHeader == nil {
+					return nil, nil
+				}
+				return proxyHeader(target), nil
+			},
 		},
 	}
 }